@@ -1,60 +1,61 @@
 package main
 
 import (
-    "archive/zip"
+    "context"
+    "encoding/json"
+    "errors"
     "flag"
     "fmt"
     "io"
     "log"
     "os"
+    "os/signal"
     "runtime"
     "strings"
+    "syscall"
     "time"
+
+    "github.com/vbauerster/mpb/v5"
     "github.com/ssut/payload-dumper-go/pkg/payload"
 )
 
-func extractPayloadBin(filename string) string {
-    zipReader, err := zip.OpenReader(filename)
-    if err != nil {
-        log.Fatalf("Not a valid zip archive: %s\n", filename)
-    }
-    defer zipReader.Close()
-
-    for _, file := range zipReader.Reader.File {
-        if file.Name == "payload.bin" && file.UncompressedSize64 > 0 {
-            zippedFile, err := file.Open()
-            if err != nil {
-                log.Fatalf("Failed to read zipped file: %s\n", file.Name)
-            }
-            tempfile, err := os.CreateTemp(os.TempDir(), "payload_*.bin")
-            if err != nil {
-                log.Fatalf("Failed to create a temp file located at %s\n", tempfile.Name())
-            }
-            defer tempfile.Close()
-            
-            _, err = io.Copy(tempfile, zippedFile)
-            if err != nil {
-                log.Fatal(err)
-            }
-            return tempfile.Name()
-        }
-    }
-    return ""
-}
-
 func usage() {
-    fmt.Fprintf(os.Stderr, "Usage: %s [options] [inputfile]\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Usage: %s [options] [inputfile|url|-]\n", os.Args[0])
     flag.PrintDefaults()
     os.Exit(2)
 }
 
+func printJSON(p *payload.Payload) error {
+    info, err := p.Info()
+    if err != nil {
+        return err
+    }
+    enc := json.NewEncoder(os.Stdout)
+    enc.SetIndent("", "  ")
+    return enc.Encode(info)
+}
+
 func main() {
     runtime.GOMAXPROCS(runtime.NumCPU())
-    
+
+    // Exiting only after run returns lets its deferred cleanup, such as
+    // removing the temporary copy of a deflated payload.bin, take place.
+    if err := run(); err != nil {
+        log.Fatal(err)
+    }
+}
+
+func run() error {
     var (
         list            bool
         partitions      string
         outputDirectory string
+        sourceDirectory string
+        verifyKey       string
+        manifestFormat  string
+        sparse          bool
+        super           bool
+        jsonOutput      bool
         concurrency     int
     )
 
@@ -62,48 +63,103 @@ func main() {
     flag.IntVar(&concurrency, "concurrency", 4, "Number of multiple workers to extract")
     flag.BoolVar(&list, "l", false, "Show list of partitions in payload.bin (shorthand)")
     flag.BoolVar(&list, "list", false, "Show list of partitions in payload.bin")
+    flag.BoolVar(&jsonOutput, "j", false, "Print payload info and extraction results as JSON to stdout (shorthand)")
+    flag.BoolVar(&jsonOutput, "json", false, "Print payload info and extraction results as JSON to stdout")
+    flag.StringVar(&manifestFormat, "m", "", "Dump the full manifest to stdout as json or text (shorthand)")
+    flag.StringVar(&manifestFormat, "manifest", "", "Dump the full manifest to stdout as json or text")
     flag.StringVar(&outputDirectory, "o", "", "Set output directory (shorthand)")
     flag.StringVar(&outputDirectory, "output", "", "Set output directory")
     flag.StringVar(&partitions, "p", "", "Dump only selected partitions (comma-separated) (shorthand)")
     flag.StringVar(&partitions, "partitions", "", "Dump only selected partitions (comma-separated)")
+    flag.BoolVar(&sparse, "S", false, "Write Android sparse images (.simg) instead of raw images (shorthand)")
+    flag.BoolVar(&sparse, "sparse", false, "Write Android sparse images (.simg) instead of raw images")
+    flag.BoolVar(&super, "u", false, "Build super.img from the extracted dynamic partitions (shorthand)")
+    flag.BoolVar(&super, "super", false, "Build super.img from the extracted dynamic partitions")
+    flag.StringVar(&sourceDirectory, "s", "", "Set source image directory for incremental payloads (shorthand)")
+    flag.StringVar(&sourceDirectory, "source", "", "Set source image directory for incremental payloads")
+    flag.StringVar(&verifyKey, "v", "", "Verify payload signatures with a PEM public key/certificate or otacerts.zip (shorthand)")
+    flag.StringVar(&verifyKey, "verify", "", "Verify payload signatures with a PEM public key/certificate or otacerts.zip")
     flag.Parse()
 
     if flag.NArg() == 0 {
         usage()
     }
 
+    // When dumping JSON or the manifest, stdout carries the document only,
+    // everything else goes to stderr.
+    var stdout io.Writer = os.Stdout
+    if jsonOutput || manifestFormat != "" {
+        stdout = os.Stderr
+    }
+
     filename := flag.Arg(0)
-    if _, err := os.Stat(filename); os.IsNotExist(err) {
-        log.Fatalf("File does not exist: %s\n", filename)
-    }
-
-    payloadBin := filename
-    if strings.HasSuffix(filename, ".zip") {
-        fmt.Println("Please wait while extracting payload.bin from the archive.")
-        payloadBin = extractPayloadBin(filename)
-        if payloadBin == "" {
-            log.Fatal("Failed to extract payload.bin from the archive.")
-        } else {
-            defer os.Remove(payloadBin)
-        }
+    if filename == "-" && verifyKey != "" {
+        return errors.New("Signatures can not be verified on a payload read from stdin")
+    }
+    if sparse && super {
+        return errors.New("super.img can only be built from raw images, not with -S")
     }
+    var p *payload.Payload
+    if filename == "-" {
+        fmt.Fprintln(stdout, "payload.bin: (stdin)")
+        p = payload.NewPayloadFromStream(os.Stdin)
+    } else {
+        isURL := strings.HasPrefix(filename, "http://") || strings.HasPrefix(filename, "https://")
+        if _, err := os.Stat(filename); !isURL && os.IsNotExist(err) {
+            return fmt.Errorf("File does not exist: %s", filename)
+        }
 
-    fmt.Printf("payload.bin: %s\n", payloadBin)
-    
-    p := payload.NewPayload(payloadBin)
+        fmt.Fprintf(stdout, "payload.bin: %s\n", filename)
+        p = payload.NewPayload(filename)
+    }
+    p.SetLogger(log.New(stdout, "", 0))
+    p.SetSourceDirectory(sourceDirectory)
+    p.SetSparseOutput(sparse)
     defer p.Close()
 
-    if err := p.Open(); err != nil {
-        log.Fatal(err)
+    // Interrupting stops downloads and the extraction, and removes the
+    // partial images.
+    ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+    defer stop()
+
+    if err := p.OpenContext(ctx); err != nil {
+        return err
     }
 
     if err := p.Init(); err != nil {
-        log.Fatal(err)
+        return err
+    }
+
+    if manifestFormat != "" {
+        var parts []string
+        if partitions != "" {
+            parts = strings.Split(partitions, ",")
+        }
+        return p.DumpManifest(os.Stdout, manifestFormat, parts)
     }
 
     if list {
-        p.PrintInfo()
-        return
+        if jsonOutput {
+            return printJSON(p)
+        }
+        p.PrintInfo(stdout)
+        return nil
+    }
+
+    if verifyKey != "" {
+        keys, err := payload.LoadPublicKeys(verifyKey)
+        if err != nil {
+            return err
+        }
+        if err := p.VerifyMetadataSignature(keys); err != nil {
+            return err
+        }
+        fmt.Fprintln(stdout, "Metadata signature: verified")
+        if err := p.VerifyPayloadSignature(keys); err != nil {
+            return err
+        }
+        fmt.Fprintln(stdout, "Payload signature: verified")
+        return nil
     }
 
     if outputDirectory == "" {
@@ -111,22 +167,39 @@ func main() {
     }
 
     if err := os.MkdirAll(outputDirectory, 0o755); err != nil {
-        log.Fatal(err)
+        return err
     }
 
+    progress := mpb.New(mpb.WithOutput(stdout))
+    p.SetProgressReporter(newProgressBars(progress))
+
     start := time.Now()
     var err error
     if partitions != "" {
         parts := strings.Split(partitions, ",")
-        err = p.ExtractSelected(outputDirectory, parts)
+        err = p.ExtractSelectedContext(ctx, outputDirectory, parts)
     } else {
-        err = p.ExtractAll(outputDirectory)
+        err = p.ExtractAllContext(ctx, outputDirectory)
     }
+    progress.Wait()
 
+    if jsonOutput {
+        if jsonErr := printJSON(p); err == nil {
+            err = jsonErr
+        }
+    }
     if err != nil {
-        log.Fatal(err)
+        return err
     }
 
     elapsed := time.Since(start)
-    fmt.Printf("\nExtraction completed in %s\n", elapsed)
+    fmt.Fprintf(stdout, "\nExtraction completed in %s\n", elapsed)
+
+    if super {
+        if err := p.BuildSuperImage(outputDirectory); err != nil {
+            return err
+        }
+        fmt.Fprintln(stdout, "super.img built")
+    }
+    return nil
 }
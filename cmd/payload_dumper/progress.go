@@ -0,0 +1,80 @@
+package main
+
+import (
+    "fmt"
+    "sync"
+    "sync/atomic"
+
+    "github.com/dustin/go-humanize"
+    "github.com/vbauerster/mpb/v5"
+    "github.com/vbauerster/mpb/v5/decor"
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+    "github.com/ssut/payload-dumper-go/pkg/payload"
+)
+
+type partitionBar struct {
+    bar    *mpb.Bar
+    status *atomic.Value
+}
+
+// progressBars shows a progress bar per partition, followed by the outcome of
+// the hash check once the partition is done.
+type progressBars struct {
+    progress *mpb.Progress
+    mu       sync.Mutex
+    bars     map[string]*partitionBar
+}
+
+func newProgressBars(progress *mpb.Progress) *progressBars {
+    return &progressBars{
+        progress: progress,
+        bars:     make(map[string]*partitionBar),
+    }
+}
+
+func (b *progressBars) get(partition *chromeos_update_engine.PartitionUpdate) *partitionBar {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    name := partition.GetPartitionName()
+    if pb, ok := b.bars[name]; ok {
+        return pb
+    }
+
+    barName := fmt.Sprintf("%s (%s)", name, humanize.Bytes(partition.GetNewPartitionInfo().GetSize()))
+    status := &atomic.Value{}
+    status.Store("")
+    bar := b.progress.AddBar(
+        int64(len(partition.Operations)),
+        mpb.PrependDecorators(
+            decor.Name(barName, decor.WCSyncSpaceR),
+        ),
+        mpb.AppendDecorators(
+            decor.Percentage(),
+            decor.Any(func(decor.Statistics) string {
+                return status.Load().(string)
+            }),
+        ),
+    )
+    pb := &partitionBar{bar: bar, status: status}
+    b.bars[name] = pb
+    return pb
+}
+
+func (b *progressBars) Start(partition *chromeos_update_engine.PartitionUpdate) {
+    b.get(partition)
+}
+
+func (b *progressBars) Increment(partition *chromeos_update_engine.PartitionUpdate) {
+    b.get(partition).bar.Increment()
+}
+
+func (b *progressBars) Done(partition *chromeos_update_engine.PartitionUpdate, result payload.ExtractResult) {
+    pb := b.get(partition)
+    if result.Status == payload.ExtractStatusOK {
+        pb.status.Store(fmt.Sprintf(" (hash %s)", result.Hash))
+    } else {
+        pb.status.Store(" (failed)")
+    }
+    pb.bar.SetTotal(0, true)
+}
@@ -3,6 +3,7 @@ module github.com/ssut/payload-dumper-go
 go 1.18
 
 require (
+    github.com/andybalholm/brotli v1.1.0
     github.com/dustin/go-humanize v1.0.1
     github.com/golang/protobuf v1.5.3
     github.com/spencercw/go-xz v0.0.0-20181128201811-c82a2123b492
@@ -0,0 +1,136 @@
+package payload
+
+import (
+    "bytes"
+    "compress/bzip2"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+
+    "github.com/andybalholm/brotli"
+)
+
+const (
+    bsdiffMagic = "BSDIFF40"
+    bsdf2Magic = "BSDF2"
+    bsdiffHeaderSize = 32
+)
+
+// Stream compression types used by the BSDF2 patch format.
+const (
+    bsdf2NoCompression = 0
+    bsdf2BZ2           = 1
+    bsdf2Brotli        = 2
+)
+
+var errCorruptPatch = errors.New("Corrupt bsdiff patch")
+
+// offtin decodes a sign-magnitude little-endian integer used by bsdiff.
+func offtin(buf []byte) int64 {
+    y := int64(binary.LittleEndian.Uint64(buf) &^ (1 << 63))
+    if buf[7]&0x80 != 0 {
+        y = -y
+    }
+    return y
+}
+
+func bsdf2Reader(compression byte, data []byte) (io.Reader, error) {
+    switch compression {
+    case bsdf2NoCompression:
+        return bytes.NewReader(data), nil
+    case bsdf2BZ2:
+        return bzip2.NewReader(bytes.NewReader(data)), nil
+    case bsdf2Brotli:
+        return brotli.NewReader(bytes.NewReader(data)), nil
+    default:
+        return nil, fmt.Errorf("Unsupported BSDF2 compression type: %d", compression)
+    }
+}
+
+// bspatch applies a BSDIFF40 or BSDF2 patch to old and returns the new data,
+// which may not be larger than limit. It stops with ctx.Err() once ctx is
+// done.
+func bspatch(ctx context.Context, old []byte, patch []byte, limit int64) ([]byte, error) {
+    if len(patch) < bsdiffHeaderSize {
+        return nil, errCorruptPatch
+    }
+
+    var compression [3]byte
+    switch {
+    case string(patch[:8]) == bsdiffMagic:
+        compression = [3]byte{bsdf2BZ2, bsdf2BZ2, bsdf2BZ2}
+    case string(patch[:5]) == bsdf2Magic:
+        copy(compression[:], patch[5:8])
+    default:
+        return nil, fmt.Errorf("Invalid bsdiff magic: %q", patch[:8])
+    }
+
+    ctrlLen := offtin(patch[8:])
+    diffLen := offtin(patch[16:])
+    newSize := offtin(patch[24:])
+    if ctrlLen < 0 || diffLen < 0 || newSize < 0 ||
+        ctrlLen > int64(len(patch)-bsdiffHeaderSize) ||
+        diffLen > int64(len(patch)-bsdiffHeaderSize)-ctrlLen {
+        return nil, errCorruptPatch
+    }
+    if newSize > limit {
+        return nil, fmt.Errorf("Patched data is too large: %d > %d", newSize, limit)
+    }
+
+    body := patch[bsdiffHeaderSize:]
+    ctrl, err := bsdf2Reader(compression[0], body[:ctrlLen])
+    if err != nil {
+        return nil, err
+    }
+    diff, err := bsdf2Reader(compression[1], body[ctrlLen:ctrlLen+diffLen])
+    if err != nil {
+        return nil, err
+    }
+    extra, err := bsdf2Reader(compression[2], body[ctrlLen+diffLen:])
+    if err != nil {
+        return nil, err
+    }
+
+    newData := make([]byte, newSize)
+    oldSize := int64(len(old))
+    var oldPos, newPos int64
+    buf := make([]byte, 24)
+    for newPos < newSize {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        if _, err := io.ReadFull(ctrl, buf); err != nil {
+            return nil, errCorruptPatch
+        }
+        diffSize := offtin(buf[0:])
+        extraSize := offtin(buf[8:])
+        seek := offtin(buf[16:])
+
+        if diffSize < 0 || diffSize > newSize-newPos {
+            return nil, errCorruptPatch
+        }
+        if _, err := io.ReadFull(diff, newData[newPos:newPos+diffSize]); err != nil {
+            return nil, errCorruptPatch
+        }
+        for i := int64(0); i < diffSize; i++ {
+            if oldPos+i >= 0 && oldPos+i < oldSize {
+                newData[newPos+i] += old[oldPos+i]
+            }
+        }
+        newPos += diffSize
+        oldPos += diffSize
+
+        if extraSize < 0 || extraSize > newSize-newPos {
+            return nil, errCorruptPatch
+        }
+        if _, err := io.ReadFull(extra, newData[newPos:newPos+extraSize]); err != nil {
+            return nil, errCorruptPatch
+        }
+        newPos += extraSize
+        oldPos += seek
+    }
+
+    return newData, nil
+}
@@ -0,0 +1,127 @@
+package payload
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "encoding/hex"
+    "testing"
+
+    "github.com/andybalholm/brotli"
+)
+
+var (
+    bspatchTestOld = []byte("The quick brown fox jumps over the lazy dog")
+    bspatchTestNew = []byte("The quick brown cat jumps over the lazy dog!!")
+    // Copy 16 bytes, add "cat", skip "fox", copy 24 bytes and add "!!".
+    bspatchTestCtrl = [][3]int64{{16, 3, 3}, {24, 2, 0}}
+)
+
+func concat(parts ...[]byte) []byte {
+    return bytes.Join(parts, nil)
+}
+
+// offtout encodes v the way offtin decodes it.
+func offtout(v int64) []byte {
+    b := make([]byte, 8)
+    if v < 0 {
+        binary.LittleEndian.PutUint64(b, uint64(-v)|1<<63)
+    } else {
+        binary.LittleEndian.PutUint64(b, uint64(v))
+    }
+    return b
+}
+
+// bsdiffTestPatch builds a BSDF2 patch from its control entries, diff and
+// extra data, with the streams compressed by compress.
+func bsdiffTestPatch(compression byte, compress func([]byte) []byte, newSize int64, ctrl [][3]int64, diff, extra []byte) []byte {
+    var ctrlData []byte
+    for _, c := range ctrl {
+        ctrlData = concat(ctrlData, offtout(c[0]), offtout(c[1]), offtout(c[2]))
+    }
+    ctrlData, diff, extra = compress(ctrlData), compress(diff), compress(extra)
+    header := concat([]byte("BSDF2"), []byte{compression, compression, compression},
+        offtout(int64(len(ctrlData))), offtout(int64(len(diff))), offtout(newSize))
+    return concat(header, ctrlData, diff, extra)
+}
+
+func uncompressed(b []byte) []byte {
+    return b
+}
+
+func brotliCompress(b []byte) []byte {
+    var out bytes.Buffer
+    w := brotli.NewWriter(&out)
+    w.Write(b)
+    w.Close()
+    return out.Bytes()
+}
+
+func TestBspatch(t *testing.T) {
+    // Made with Python's bz2 module, in the layout of bsdiff 4.
+    bsdiff40, _ := hex.DecodeString("42534449464634302f0000000000000027000000000000002d00000000000000" +
+        "425a6839314159265359f4f542ee00000e600058084040200021b534c0c02d8a4019c2af0bb9229c28487a7aa17700" +
+        "425a68393141592653598dbc37970000005000400004002000210082831772453850908dbc3797" +
+        "425a6839314159265359b84e35f700000191802000280004002000219a68334d111e2ee48a70a121709c6bee")
+    diff := make([]byte, 40)
+    patches := map[string][]byte{
+        "BSDIFF40": bsdiff40,
+        "BSDF2": bsdiffTestPatch(bsdf2NoCompression, uncompressed, int64(len(bspatchTestNew)), bspatchTestCtrl, diff, []byte("cat!!")),
+        "BSDF2 brotli": bsdiffTestPatch(bsdf2Brotli, brotliCompress, int64(len(bspatchTestNew)), bspatchTestCtrl, diff, []byte("cat!!")),
+    }
+    for name, patch := range patches {
+        got, err := bspatch(context.Background(), bspatchTestOld, patch, int64(len(bspatchTestNew)))
+        if err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        if !bytes.Equal(got, bspatchTestNew) {
+            t.Fatalf("%s: got %q, want %q", name, got, bspatchTestNew)
+        }
+        if _, err := bspatch(context.Background(), bspatchTestOld, patch, int64(len(bspatchTestNew))-1); err == nil {
+            t.Fatalf("%s: expected an error for output larger than the limit", name)
+        }
+    }
+}
+
+func TestBspatchNegativeSeek(t *testing.T) {
+    // Seek to 10, copy old[10:20], seek back to 0 and copy old[0:10], with
+    // the first byte of each copy changed by the diff.
+    ctrl := [][3]int64{{0, 0, 10}, {10, 0, -20}, {10, 0, 0}}
+    diff := make([]byte, 20)
+    diff[0], diff[10] = 1, 0xFF
+    patch := bsdiffTestPatch(bsdf2NoCompression, uncompressed, 20, ctrl, diff, nil)
+
+    want := concat(bspatchTestOld[10:20], bspatchTestOld[:10])
+    want[0]++
+    want[10]--
+    got, err := bspatch(context.Background(), bspatchTestOld, patch, 20)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, want) {
+        t.Fatalf("got %q, want %q", got, want)
+    }
+}
+
+func TestBspatchCorrupt(t *testing.T) {
+    diff := make([]byte, 40)
+    valid := bsdiffTestPatch(bsdf2NoCompression, uncompressed, int64(len(bspatchTestNew)), bspatchTestCtrl, diff, []byte("cat!!"))
+    tests := map[string][]byte{
+        "short header": valid[:bsdiffHeaderSize-1],
+        "bad magic": concat([]byte("BSDIFF41"), valid[8:]),
+        // The second control entry is cut short.
+        "truncated ctrl": bsdiffTestPatch(bsdf2NoCompression, func(b []byte) []byte {
+            if len(b) == 48 {
+                return b[:40]
+            }
+            return b
+        }, int64(len(bspatchTestNew)), bspatchTestCtrl, diff, []byte("cat!!")),
+        "diff past new size": bsdiffTestPatch(bsdf2NoCompression, uncompressed, 10, bspatchTestCtrl, diff, []byte("cat!!")),
+        "truncated extra": valid[:len(valid)-1],
+    }
+    for name, patch := range tests {
+        if _, err := bspatch(context.Background(), bspatchTestOld, patch, 1<<20); err == nil {
+            t.Errorf("%s: expected an error", name)
+        }
+    }
+}
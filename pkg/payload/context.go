@@ -0,0 +1,41 @@
+package payload
+
+import (
+    "context"
+    "io"
+)
+
+// contextReader fails reads once ctx is done. Decompressors and patchers
+// reading operation data through it stop at their next read.
+type contextReader struct {
+    ctx context.Context
+    r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+    if err := r.ctx.Err(); err != nil {
+        return 0, err
+    }
+    return r.r.Read(p)
+}
+
+// contextFile fails reads and writes once ctx is done, so that building
+// verity data and hashing a large image can be cancelled.
+type contextFile struct {
+    ctx context.Context
+    f   readerWriterAt
+}
+
+func (f *contextFile) ReadAt(p []byte, off int64) (int, error) {
+    if err := f.ctx.Err(); err != nil {
+        return 0, err
+    }
+    return f.f.ReadAt(p, off)
+}
+
+func (f *contextFile) WriteAt(p []byte, off int64) (int, error) {
+    if err := f.ctx.Err(); err != nil {
+        return 0, err
+    }
+    return f.f.WriteAt(p, off)
+}
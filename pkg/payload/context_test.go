@@ -0,0 +1,78 @@
+package payload
+
+import (
+    "bytes"
+    "context"
+    "errors"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+    "time"
+)
+
+func TestPatchCancelled(t *testing.T) {
+    ctx, cancel := context.WithCancel(context.Background())
+    cancel()
+
+    old := lz4TestData(6000)
+    src, compressed := lz4diffTestFile(t, old, lz4diffLZ4, false)
+    zucchini, zucchiniData := zucchiniTestPatch(make([]byte, 64), true, zucchiniExeTypeNoOp)
+    tests := []struct {
+        name  string
+        apply func() ([]byte, error)
+    }{
+        {"bspatch", func() ([]byte, error) {
+            return bspatch(ctx, old, bsdf2Patch(old, old), int64(len(old)))
+        }},
+        {"zucchini", func() ([]byte, error) {
+            return zucchinipatch(ctx, make([]byte, 64), zucchini, int64(len(zucchiniData)))
+        }},
+        {"lz4diff", func() ([]byte, error) {
+            return lz4diffpatch(ctx, compressed, lz4diffTestPatch(src, src, bsdf2Patch(old, old)), int64(len(compressed)))
+        }},
+    }
+    for _, test := range tests {
+        if _, err := test.apply(); !errors.Is(err, context.Canceled) {
+            t.Errorf("%s: got %v, want context.Canceled", test.name, err)
+        }
+    }
+}
+
+func TestHTTPReaderCancelled(t *testing.T) {
+    data := make([]byte, 1000)
+    release := make(chan struct{})
+    defer close(release)
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Header.Get("Range") != "bytes=0-0" {
+            // Stall every read until the test is over.
+            select {
+            case <-release:
+            case <-r.Context().Done():
+            }
+            return
+        }
+        http.ServeContent(w, r, "payload.bin", time.Time{}, bytes.NewReader(data))
+    }))
+    defer server.Close()
+
+    ctx, cancel := context.WithCancel(context.Background())
+    r, err := NewHTTPReaderContext(ctx, server.URL+"/payload.bin")
+    if err != nil {
+        t.Fatal(err)
+    }
+    time.AfterFunc(50*time.Millisecond, cancel)
+
+    done := make(chan error, 1)
+    go func() {
+        _, err := r.ReadAt(make([]byte, 10), 0)
+        done <- err
+    }()
+    select {
+    case err := <-done:
+        if !errors.Is(err, context.Canceled) {
+            t.Fatalf("got %v, want context.Canceled", err)
+        }
+    case <-time.After(10 * time.Second):
+        t.Fatal("read was not cancelled")
+    }
+}
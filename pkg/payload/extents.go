@@ -0,0 +1,107 @@
+package payload
+
+import (
+    "fmt"
+    "io"
+
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// extentsSize returns the number of bytes covered by the given extents.
+func extentsSize(extents []*chromeos_update_engine.Extent) int64 {
+    var size int64
+    for _, e := range extents {
+        size += int64(e.GetNumBlocks()) * blockSize
+    }
+    return size
+}
+
+// readExtents reads the given extents from r and returns them concatenated.
+func readExtents(r io.ReaderAt, extents []*chromeos_update_engine.Extent) ([]byte, error) {
+    buf := make([]byte, extentsSize(extents))
+    pos := int64(0)
+    for _, e := range extents {
+        length := int64(e.GetNumBlocks()) * blockSize
+        n, err := r.ReadAt(buf[pos:pos+length], int64(e.GetStartBlock())*blockSize)
+        if err != nil && !(err == io.EOF && int64(n) == length) {
+            return nil, err
+        }
+        pos += length
+    }
+    return buf, nil
+}
+
+// writeExtents scatters data across the given extents of w in order.
+func writeExtents(w io.WriterAt, extents []*chromeos_update_engine.Extent, data []byte) error {
+    if int64(len(data)) != extentsSize(extents) {
+        return fmt.Errorf("Extent size mismatch: %d != %d", len(data), extentsSize(extents))
+    }
+    pos := int64(0)
+    for _, e := range extents {
+        length := int64(e.GetNumBlocks()) * blockSize
+        if _, err := w.WriteAt(data[pos:pos+length], int64(e.GetStartBlock())*blockSize); err != nil {
+            return err
+        }
+        pos += length
+    }
+    return nil
+}
+
+// extentWriter scatters sequential writes across the given extents of w in
+// order. Bytes past the end of the extents are counted but dropped, so that
+// callers can report the size mismatch.
+type extentWriter struct {
+    w       io.WriterAt
+    extents []*chromeos_update_engine.Extent
+    index   int
+    pos     int64
+}
+
+func newExtentWriter(w io.WriterAt, extents []*chromeos_update_engine.Extent) *extentWriter {
+    return &extentWriter{
+        w:       w,
+        extents: extents,
+    }
+}
+
+func (ew *extentWriter) Write(p []byte) (int, error) {
+    written := len(p)
+    for len(p) > 0 && ew.index < len(ew.extents) {
+        e := ew.extents[ew.index]
+        length := int64(e.GetNumBlocks()) * blockSize
+        n := int64(len(p))
+        if n > length-ew.pos {
+            n = length - ew.pos
+        }
+        if _, err := ew.w.WriteAt(p[:n], int64(e.GetStartBlock())*blockSize+ew.pos); err != nil {
+            return 0, err
+        }
+        p = p[n:]
+        ew.pos += n
+        if ew.pos == length {
+            ew.index++
+            ew.pos = 0
+        }
+    }
+    return written, nil
+}
+
+// writeZeros fills the given extents of w with zeros.
+func writeZeros(w io.WriterAt, extents []*chromeos_update_engine.Extent) error {
+    zeros := make([]byte, 256*blockSize)
+    for _, e := range extents {
+        offset := int64(e.GetStartBlock()) * blockSize
+        end := offset + int64(e.GetNumBlocks())*blockSize
+        for offset < end {
+            n := end - offset
+            if n > int64(len(zeros)) {
+                n = int64(len(zeros))
+            }
+            if _, err := w.WriteAt(zeros[:n], offset); err != nil {
+                return err
+            }
+            offset += n
+        }
+    }
+    return nil
+}
@@ -0,0 +1,143 @@
+package payload
+
+import (
+    "fmt"
+    "io"
+
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// Parameters of the Reed-Solomon code used by libfec: RS(255, 255-roots)
+// over GF(2^8) with the primitive polynomial x^8+x^4+x^3+x^2+1.
+const (
+    fecRSM = 255
+    fecGFPoly = 0x11d
+)
+
+var (
+    gfExp [fecRSM + 1]byte
+    gfLog [fecRSM + 1]int
+)
+
+func init() {
+    gfLog[0] = fecRSM
+    gfExp[fecRSM] = 0
+    sr := 1
+    for i := 0; i < fecRSM; i++ {
+        gfLog[sr] = i
+        gfExp[i] = byte(sr)
+        sr <<= 1
+        if sr&0x100 != 0 {
+            sr ^= fecGFPoly
+        }
+        sr &= fecRSM
+    }
+}
+
+// rsEncoder is a systematic Reed-Solomon encoder with the first consecutive
+// root 0 and primitive element 1, matching libfec's init_rs_char.
+type rsEncoder struct {
+    roots int
+    // genpoly holds the generator polynomial in log form.
+    genpoly []int
+}
+
+func newRSEncoder(roots int) *rsEncoder {
+    genpoly := make([]int, roots+1)
+    genpoly[0] = 1
+    for i := 0; i < roots; i++ {
+        genpoly[i+1] = 1
+        for j := i; j > 0; j-- {
+            if genpoly[j] != 0 {
+                genpoly[j] = genpoly[j-1] ^ int(gfExp[(gfLog[genpoly[j]]+i)%fecRSM])
+            } else {
+                genpoly[j] = genpoly[j-1]
+            }
+        }
+        genpoly[0] = int(gfExp[(gfLog[genpoly[0]]+i)%fecRSM])
+    }
+    for i := range genpoly {
+        genpoly[i] = gfLog[genpoly[i]]
+    }
+    return &rsEncoder{roots: roots, genpoly: genpoly}
+}
+
+// encode computes the parity of data, which must hold 255-roots bytes.
+func (rs *rsEncoder) encode(data []byte, parity []byte) {
+    for i := range parity {
+        parity[i] = 0
+    }
+    for _, b := range data {
+        feedback := gfLog[b^parity[0]]
+        if feedback != fecRSM {
+            for j := 1; j < rs.roots; j++ {
+                parity[j] ^= gfExp[(feedback+rs.genpoly[rs.roots-j])%fecRSM]
+            }
+        }
+        copy(parity, parity[1:])
+        if feedback != fecRSM {
+            parity[rs.roots-1] = gfExp[(feedback+rs.genpoly[0])%fecRSM]
+        } else {
+            parity[rs.roots-1] = 0
+        }
+    }
+}
+
+// writeFEC computes the Reed-Solomon data described by partition over the
+// extracted image in f and writes it into the image. Codewords are
+// interleaved across the whole data range, the way libfec lays them out.
+func writeFEC(f readerWriterAt, partition *chromeos_update_engine.PartitionUpdate) error {
+    dataExtent := partition.GetFecDataExtent()
+    fecExtent := partition.GetFecExtent()
+    if fecExtent.GetNumBlocks() == 0 {
+        return nil
+    }
+
+    roots := int(partition.GetFecRoots())
+    if roots <= 0 || roots >= fecRSM {
+        return fmt.Errorf("Invalid FEC roots: %d", roots)
+    }
+    rsN := uint64(fecRSM - roots)
+
+    dataBlocks := dataExtent.GetNumBlocks()
+    rounds := (dataBlocks + rsN - 1) / rsN
+    if rounds*uint64(roots) != fecExtent.GetNumBlocks() {
+        return fmt.Errorf("FEC size mismatch: %d != %d", rounds*uint64(roots), fecExtent.GetNumBlocks())
+    }
+
+    rs := newRSEncoder(roots)
+    dataOffset := int64(dataExtent.GetStartBlock() * blockSize)
+    fecOffset := int64(fecExtent.GetStartBlock() * blockSize)
+    block := make([]byte, blockSize)
+    rsBlocks := make([]byte, blockSize*rsN)
+    fec := make([]byte, blockSize*roots)
+    for i := uint64(0); i < rounds; i++ {
+        // Each round encodes one byte of rsN blocks that lie rounds blocks
+        // apart, for every byte offset in a block.
+        for j := uint64(0); j < rsN; j++ {
+            // Blocks past the data, or past the end of the image, are zeros.
+            n := 0
+            if index := i + j*rounds; index < dataBlocks {
+                var err error
+                n, err = f.ReadAt(block, dataOffset+int64(index*blockSize))
+                if err != nil && err != io.EOF {
+                    return err
+                }
+            }
+            for k := n; k < len(block); k++ {
+                block[k] = 0
+            }
+            for k := uint64(0); k < blockSize; k++ {
+                rsBlocks[k*rsN+j] = block[k]
+            }
+        }
+
+        for k := uint64(0); k < blockSize; k++ {
+            rs.encode(rsBlocks[k*rsN:(k+1)*rsN], fec[k*uint64(roots):(k+1)*uint64(roots)])
+        }
+        if _, err := f.WriteAt(fec, fecOffset+int64(i)*int64(len(fec))); err != nil {
+            return err
+        }
+    }
+    return nil
+}
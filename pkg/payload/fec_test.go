@@ -0,0 +1,62 @@
+package payload
+
+import (
+    "encoding/hex"
+    "testing"
+
+    "google.golang.org/protobuf/proto"
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// The expected parity was computed in Python by dividing each codeword by the
+// generator polynomial of libfec's RS(255, 255-roots) code, with roots 1, a,
+// ..., a^(roots-1) over GF(2^8) modulo 0x11d, the code `fec --encode` and
+// avbtool write. It covers the data and hash tree of TestWriteHashTreeGolden.
+func TestWriteFECGolden(t *testing.T) {
+    tests := []struct {
+        roots  uint32
+        blocks uint64
+        fec    string
+        start  string
+    }{
+        {2, 4, "024996c25e639ebdddc16d65bc13df75cd342c7f534724048ff393261531431c", "029ef407ba4df9a5"},
+        {24, 48, "72765436737a90bfe050c2b2979d8249af30a58181c4d0d6d1071efc31e815c5", "f1f060b0da306f94"},
+    }
+    for _, test := range tests {
+        img := verityTestImage(304 + int(test.blocks))
+        partition := &chromeos_update_engine.PartitionUpdate{
+            HashTreeDataExtent: testExtent(0, 300),
+            HashTreeExtent: testExtent(300, 4),
+            HashTreeAlgorithm: proto.String("sha256"),
+            HashTreeSalt: []byte("saltysalt"),
+            FecDataExtent: testExtent(0, 304),
+            FecExtent: testExtent(304, test.blocks),
+            FecRoots: proto.Uint32(test.roots),
+        }
+        if err := writeHashTree(img, partition); err != nil {
+            t.Fatal(err)
+        }
+        if err := writeFEC(img, partition); err != nil {
+            t.Fatalf("roots %d: %v", test.roots, err)
+        }
+
+        fec := img[304*blockSize:]
+        if got := hex.EncodeToString(fec[:8]); got != test.start {
+            t.Errorf("roots %d: FEC starts with %s, want %s", test.roots, got, test.start)
+        }
+        if got := sha256Hex(fec); got != test.fec {
+            t.Errorf("roots %d: FEC hash %s, want %s", test.roots, got, test.fec)
+        }
+    }
+}
+
+func TestWriteFECSizeMismatch(t *testing.T) {
+    partition := &chromeos_update_engine.PartitionUpdate{
+        FecDataExtent: testExtent(0, 304),
+        FecExtent: testExtent(304, 2),
+        FecRoots: proto.Uint32(2),
+    }
+    if err := writeFEC(verityTestImage(306), partition); err == nil {
+        t.Fatal("expected an error for a FEC extent of the wrong size")
+    }
+}
@@ -0,0 +1,179 @@
+package payload
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "sync"
+)
+
+const (
+    // httpChunkSize is the granularity of range requests. Small reads, like
+    // those of the zip directory or the payload header, are served from the
+    // cached chunks.
+    httpChunkSize   = 1 << 20
+    httpCacheChunks = 16
+)
+
+// HTTPReader reads a remote file with HTTP Range requests, so only the parts
+// that are actually read get downloaded.
+type HTTPReader struct {
+    ctx    context.Context
+    url    string
+    client *http.Client
+    size   int64
+
+    mu     sync.Mutex
+    chunks map[int64][]byte
+    // order lists the cached chunks, least recently used first.
+    order []int64
+}
+
+// NewHTTPReader returns a reader for the file at rawURL. The server has to
+// support range requests.
+func NewHTTPReader(rawURL string) (*HTTPReader, error) {
+    return NewHTTPReaderContext(context.Background(), rawURL)
+}
+
+// NewHTTPReaderContext is like NewHTTPReader, but the requests of the reader,
+// including those of later reads, are cancelled once ctx is done.
+func NewHTTPReaderContext(ctx context.Context, rawURL string) (*HTTPReader, error) {
+    r := &HTTPReader{
+        ctx:    ctx,
+        url:    rawURL,
+        client: http.DefaultClient,
+        chunks: make(map[int64][]byte),
+    }
+
+    resp, err := r.get(0, 0)
+    if err != nil {
+        return nil, err
+    }
+    resp.Body.Close()
+
+    // Content-Range: bytes 0-0/<size>
+    contentRange := resp.Header.Get("Content-Range")
+    i := strings.LastIndexByte(contentRange, '/')
+    if i < 0 {
+        return nil, fmt.Errorf("Invalid Content-Range: %q", contentRange)
+    }
+    size, err := strconv.ParseInt(contentRange[i+1:], 10, 64)
+    if err != nil {
+        return nil, fmt.Errorf("Invalid Content-Range: %q", contentRange)
+    }
+    r.size = size
+    return r, nil
+}
+
+func (r *HTTPReader) get(start, end int64) (*http.Response, error) {
+    req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url, nil)
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+    resp, err := r.client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    if resp.StatusCode != http.StatusPartialContent {
+        resp.Body.Close()
+        if resp.StatusCode == http.StatusOK {
+            return nil, fmt.Errorf("Server does not support range requests: %s", r.url)
+        }
+        return nil, fmt.Errorf("Unexpected HTTP status: %s (%s)", resp.Status, r.url)
+    }
+    return resp, nil
+}
+
+// Size returns the size of the remote file.
+func (r *HTTPReader) Size() int64 {
+    return r.size
+}
+
+func (r *HTTPReader) chunk(index int64) ([]byte, error) {
+    r.mu.Lock()
+    if chunk, ok := r.chunks[index]; ok {
+        r.touch(index)
+        r.mu.Unlock()
+        return chunk, nil
+    }
+    r.mu.Unlock()
+
+    start := index * httpChunkSize
+    end := start + httpChunkSize
+    if end > r.size {
+        end = r.size
+    }
+    resp, err := r.get(start, end-1)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+
+    chunk := make([]byte, end-start)
+    if _, err := io.ReadFull(resp.Body, chunk); err != nil {
+        return nil, err
+    }
+
+    r.mu.Lock()
+    defer r.mu.Unlock()
+    if _, ok := r.chunks[index]; !ok {
+        if len(r.order) >= httpCacheChunks {
+            delete(r.chunks, r.order[0])
+            r.order = r.order[1:]
+        }
+        r.chunks[index] = chunk
+        r.order = append(r.order, index)
+    }
+    return chunk, nil
+}
+
+// touch marks the chunk as most recently used. r.mu must be held.
+func (r *HTTPReader) touch(index int64) {
+    for i, v := range r.order {
+        if v == index {
+            r.order = append(append(r.order[:i:i], r.order[i+1:]...), index)
+            return
+        }
+    }
+}
+
+func (r *HTTPReader) ReadAt(p []byte, off int64) (int, error) {
+    if off < 0 {
+        return 0, errors.New("Negative offset")
+    }
+    n := 0
+    for n < len(p) && off+int64(n) < r.size {
+        pos := off + int64(n)
+        chunk, err := r.chunk(pos / httpChunkSize)
+        if err != nil {
+            return n, err
+        }
+        n += copy(p[n:], chunk[pos%httpChunkSize:])
+    }
+    if n < len(p) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+// isURL reports whether name is an http(s) URL.
+func isURL(name string) bool {
+    return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// isZipName reports whether name, a path or a URL, refers to a zip file.
+func isZipName(name string) bool {
+    if isURL(name) {
+        if u, err := url.Parse(name); err == nil {
+            name = u.Path
+        }
+    }
+    return strings.HasSuffix(name, ".zip")
+}
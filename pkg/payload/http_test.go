@@ -0,0 +1,122 @@
+package payload
+
+import (
+    "archive/zip"
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "sync/atomic"
+    "testing"
+    "time"
+
+    "google.golang.org/protobuf/proto"
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// testPayload returns a payload whose system partition is image, written by
+// a single REPLACE operation.
+func testPayload(t *testing.T, image []byte) []byte {
+    imageHash := sha256.Sum256(image)
+    manifest, err := proto.Marshal(&chromeos_update_engine.DeltaArchiveManifest{
+        BlockSize: proto.Uint32(blockSize),
+        Partitions: []*chromeos_update_engine.PartitionUpdate{{
+            PartitionName: proto.String("system"),
+            NewPartitionInfo: &chromeos_update_engine.PartitionInfo{
+                Size: proto.Uint64(uint64(len(image))),
+                Hash: imageHash[:],
+            },
+            Operations: []*chromeos_update_engine.InstallOperation{{
+                Type: chromeos_update_engine.InstallOperation_REPLACE.Enum(),
+                DataOffset: proto.Uint64(0),
+                DataLength: proto.Uint64(uint64(len(image))),
+                DstExtents: []*chromeos_update_engine.Extent{testExtent(0, uint64(len(image)/blockSize))},
+                DataSha256Hash: imageHash[:],
+            }},
+        }},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    header := make([]byte, 24)
+    copy(header, payloadHeaderMagic)
+    binary.BigEndian.PutUint64(header[4:], brilloMajorPayloadVersion)
+    binary.BigEndian.PutUint64(header[12:], uint64(len(manifest)))
+    return concat(header, manifest, image)
+}
+
+// countingWriter counts the bytes of the response bodies it writes.
+type countingWriter struct {
+    http.ResponseWriter
+    n *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+    n, err := w.ResponseWriter.Write(p)
+    atomic.AddInt64(w.n, int64(n))
+    return n, err
+}
+
+func TestExtractZipOverHTTP(t *testing.T) {
+    image := make([]byte, 16*blockSize)
+    for i := range image {
+        image[i] = byte(i*7 + i>>9)
+    }
+
+    // The payload follows a large entry that should never be downloaded.
+    var archive bytes.Buffer
+    zw := zip.NewWriter(&archive)
+    for _, entry := range []struct {
+        name string
+        data []byte
+    }{
+        {"system.transfer.list", make([]byte, 32<<20)},
+        {zipPayloadName, testPayload(t, image)},
+    } {
+        w, err := zw.CreateHeader(&zip.FileHeader{Name: entry.name, Method: zip.Store})
+        if err != nil {
+            t.Fatal(err)
+        }
+        if _, err := w.Write(entry.data); err != nil {
+            t.Fatal(err)
+        }
+    }
+    if err := zw.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    var served int64
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        http.ServeContent(countingWriter{w, &served}, r, "ota.zip", time.Time{}, bytes.NewReader(archive.Bytes()))
+    }))
+    defer server.Close()
+
+    p := NewPayload(server.URL + "/ota.zip")
+    if err := p.Open(); err != nil {
+        t.Fatal(err)
+    }
+    defer p.Close()
+    if err := p.Init(); err != nil {
+        t.Fatal(err)
+    }
+    dir := t.TempDir()
+    if err := p.ExtractAll(dir); err != nil {
+        t.Fatal(err)
+    }
+
+    got, err := os.ReadFile(filepath.Join(dir, "system.img"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, image) {
+        t.Fatal("extracted image differs from the payload")
+    }
+    // The directory and the payload are read, a chunk each.
+    if max := int64(archive.Len() / 8); served > max {
+        t.Fatalf("served %d of %d bytes, want at most %d", served, archive.Len(), max)
+    }
+}
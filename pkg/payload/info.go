@@ -0,0 +1,271 @@
+package payload
+
+import (
+    "encoding/hex"
+    "errors"
+    "fmt"
+    "strings"
+    "time"
+
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// Info is a machine-readable description of a payload and, once partitions
+// have been extracted, of the extraction results.
+type Info struct {
+    Header   HeaderInfo      `json:"header"`
+    Manifest ManifestInfo    `json:"manifest"`
+    Results  []ExtractResult `json:"results,omitempty"`
+}
+
+type HeaderInfo struct {
+    Version                 uint64 `json:"version"`
+    ManifestLength          uint64 `json:"manifest_length"`
+    MetadataSignatureLength uint32 `json:"metadata_signature_length"`
+    MetadataSize            int64  `json:"metadata_size"`
+    DataOffset              int64  `json:"data_offset"`
+}
+
+type ManifestInfo struct {
+    BlockSize                uint32                `json:"block_size"`
+    MinorVersion             uint32                `json:"minor_version"`
+    MaxTimestamp             int64                 `json:"max_timestamp,omitempty"`
+    SecurityPatchLevel       string                `json:"security_patch_level,omitempty"`
+    PartialUpdate            bool                  `json:"partial_update"`
+    DynamicPartitionMetadata *DynamicPartitionInfo `json:"dynamic_partition_metadata,omitempty"`
+    ApexInfo                 []ApexInfo            `json:"apex_info,omitempty"`
+    Partitions               []PartitionSummary    `json:"partitions"`
+}
+
+type DynamicPartitionInfo struct {
+    SnapshotEnabled      bool                `json:"snapshot_enabled"`
+    VabcEnabled          bool                `json:"vabc_enabled"`
+    VabcCompressionParam string              `json:"vabc_compression_param,omitempty"`
+    CowVersion           uint32              `json:"cow_version,omitempty"`
+    VabcFeatureSet       *VABCFeatureSetInfo `json:"vabc_feature_set,omitempty"`
+    CompressionFactor    uint64              `json:"compression_factor,omitempty"`
+    Groups               []DynamicGroupInfo  `json:"groups"`
+}
+
+type VABCFeatureSetInfo struct {
+    Threaded    bool `json:"threaded"`
+    BatchWrites bool `json:"batch_writes"`
+}
+
+type DynamicGroupInfo struct {
+    Name       string   `json:"name"`
+    Size       uint64   `json:"size"`
+    Partitions []string `json:"partitions"`
+}
+
+type ApexInfo struct {
+    PackageName      string `json:"package_name"`
+    Version          int64  `json:"version"`
+    IsCompressed     bool   `json:"is_compressed"`
+    DecompressedSize int64  `json:"decompressed_size,omitempty"`
+}
+
+type PartitionSummary struct {
+    Name           string         `json:"name"`
+    Size           uint64         `json:"size"`
+    Hash           string         `json:"hash,omitempty"`
+    OldSize        uint64         `json:"old_size,omitempty"`
+    OldHash        string         `json:"old_hash,omitempty"`
+    Version        string         `json:"version,omitempty"`
+    Operations     int            `json:"operations"`
+    OperationTypes map[string]int `json:"operation_types"`
+}
+
+// ExtractResult is the outcome of extracting one partition.
+type ExtractResult struct {
+    Name       string     `json:"name"`
+    Status     string     `json:"status"`
+    Error      string     `json:"error,omitempty"`
+    DurationMs int64      `json:"duration_ms"`
+    Hash       HashStatus `json:"hash"`
+
+    err error
+}
+
+const (
+    ExtractStatusOK     = "ok"
+    ExtractStatusFailed = "failed"
+)
+
+// Info describes the payload. Results of previous extractions are included.
+func (p *Payload) Info() (*Info, error) {
+    if !p.initialized {
+        return nil, errors.New("Payload has not been initialized")
+    }
+
+    manifest := p.deltaArchiveManifest
+    info := &Info{
+        Header: HeaderInfo{
+            Version:                 p.header.Version,
+            ManifestLength:          p.header.ManifestLen,
+            MetadataSignatureLength: p.header.MetadataSignatureLen,
+            MetadataSize:            p.metadataSize,
+            DataOffset:              p.dataOffset,
+        },
+        Manifest: ManifestInfo{
+            BlockSize:          manifest.GetBlockSize(),
+            MinorVersion:       manifest.GetMinorVersion(),
+            MaxTimestamp:       manifest.GetMaxTimestamp(),
+            SecurityPatchLevel: manifest.GetSecurityPatchLevel(),
+            PartialUpdate:      manifest.GetPartialUpdate(),
+            Partitions:         []PartitionSummary{},
+        },
+        Results: p.Results(),
+    }
+
+    if metadata := manifest.GetDynamicPartitionMetadata(); metadata != nil {
+        dynamic := &DynamicPartitionInfo{
+            SnapshotEnabled:      metadata.GetSnapshotEnabled(),
+            VabcEnabled:          metadata.GetVabcEnabled(),
+            VabcCompressionParam: metadata.GetVabcCompressionParam(),
+            CowVersion:           metadata.GetCowVersion(),
+            CompressionFactor:    metadata.GetCompressionFactor(),
+            Groups:               []DynamicGroupInfo{},
+        }
+        if featureSet := metadata.GetVabcFeatureSet(); featureSet != nil {
+            dynamic.VabcFeatureSet = &VABCFeatureSetInfo{
+                Threaded:    featureSet.GetThreaded(),
+                BatchWrites: featureSet.GetBatchWrites(),
+            }
+        }
+        for _, group := range metadata.GetGroups() {
+            dynamic.Groups = append(dynamic.Groups, DynamicGroupInfo{
+                Name:       group.GetName(),
+                Size:       group.GetSize(),
+                Partitions: append([]string{}, group.GetPartitionNames()...),
+            })
+        }
+        info.Manifest.DynamicPartitionMetadata = dynamic
+    }
+
+    for _, apex := range manifest.GetApexInfo() {
+        info.Manifest.ApexInfo = append(info.Manifest.ApexInfo, ApexInfo{
+            PackageName:      apex.GetPackageName(),
+            Version:          apex.GetVersion(),
+            IsCompressed:     apex.GetIsCompressed(),
+            DecompressedSize: apex.GetDecompressedSize(),
+        })
+    }
+
+    for _, partition := range manifest.Partitions {
+        summary := PartitionSummary{
+            Name:           partition.GetPartitionName(),
+            Size:           partition.GetNewPartitionInfo().GetSize(),
+            Hash:           hex.EncodeToString(partition.GetNewPartitionInfo().GetHash()),
+            OldSize:        partition.GetOldPartitionInfo().GetSize(),
+            OldHash:        hex.EncodeToString(partition.GetOldPartitionInfo().GetHash()),
+            Version:        partition.GetVersion(),
+            Operations:     len(partition.GetOperations()),
+            OperationTypes: make(map[string]int),
+        }
+        for _, operation := range partition.GetOperations() {
+            summary.OperationTypes[operation.GetType().String()]++
+        }
+        info.Manifest.Partitions = append(info.Manifest.Partitions, summary)
+    }
+    return info, nil
+}
+
+// recordResult stores the outcome of extracting partition and reports it as
+// done.
+func (p *Payload) recordResult(partition *chromeos_update_engine.PartitionUpdate, start time.Time, status HashStatus, err error) {
+    result := &ExtractResult{
+        Name:       partition.GetPartitionName(),
+        Status:     ExtractStatusOK,
+        DurationMs: time.Since(start).Milliseconds(),
+        Hash:       status,
+    }
+    if err != nil {
+        result.Status = ExtractStatusFailed
+        result.Error = err.Error()
+        result.err = err
+    }
+
+    p.resultsMu.Lock()
+    if p.results == nil {
+        p.results = make(map[string]*ExtractResult)
+    }
+    p.results[result.Name] = result
+    p.resultsMu.Unlock()
+
+    if p.progress != nil {
+        p.progress.Done(partition, *result)
+    }
+}
+
+// Results returns the outcome of every partition extracted so far, in
+// manifest order.
+func (p *Payload) Results() []ExtractResult {
+    p.resultsMu.Lock()
+    defer p.resultsMu.Unlock()
+
+    var results []ExtractResult
+    for _, partition := range p.deltaArchiveManifest.GetPartitions() {
+        if result, ok := p.results[partition.GetPartitionName()]; ok {
+            results = append(results, *result)
+        }
+    }
+    return results
+}
+
+// PartitionError is the failure to extract a single partition.
+type PartitionError struct {
+    Partition string
+    Err       error
+}
+
+func (e *PartitionError) Error() string {
+    return fmt.Sprintf("%s: %s", e.Partition, e.Err)
+}
+
+func (e *PartitionError) Unwrap() error {
+    return e.Err
+}
+
+// ExtractError is returned when one or more partitions failed to extract.
+type ExtractError struct {
+    Errors []*PartitionError
+}
+
+func (e *ExtractError) Error() string {
+    var messages []string
+    for _, err := range e.Errors {
+        messages = append(messages, err.Error())
+    }
+    return fmt.Sprintf("Failed to extract %d partition(s): %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+// Is reports whether any of the partition errors matches target, so that
+// errors.Is(err, ErrZucchiniUnsupported) works on the aggregated error.
+func (e *ExtractError) Is(target error) bool {
+    for _, err := range e.Errors {
+        if errors.Is(err, target) {
+            return true
+        }
+    }
+    return false
+}
+
+// extractError collects the failed results of partitions into an
+// *ExtractError, or returns nil if all of them succeeded.
+func (p *Payload) extractError(partitions []*chromeos_update_engine.PartitionUpdate) error {
+    p.resultsMu.Lock()
+    defer p.resultsMu.Unlock()
+
+    var errs []*PartitionError
+    for _, partition := range partitions {
+        result, ok := p.results[partition.GetPartitionName()]
+        if ok && result.err != nil {
+            errs = append(errs, &PartitionError{Partition: result.Name, Err: result.err})
+        }
+    }
+    if len(errs) == 0 {
+        return nil
+    }
+    return &ExtractError{Errors: errs}
+}
@@ -0,0 +1,305 @@
+package payload
+
+import (
+    "encoding/binary"
+    "errors"
+)
+
+// This file implements the LZ4 block format. LZ4DIFF patches are applied to
+// decompressed data, which then has to be compressed again exactly like the
+// device does, so the compressors here follow liblz4 1.9.4 step by step.
+
+const (
+    lz4MinMatch = 4
+    lz4MFLimit = 12
+    lz4LastLiterals = 5
+    lz4MinLength = lz4MFLimit + 1
+    lz4MLBits = 4
+    lz4MLMask = 1<<lz4MLBits - 1
+    lz4RunMask = 1<<(8-lz4MLBits) - 1
+    lz4DistanceMax = 65535
+
+    lz4HashLog = 12
+    lz4SkipTrigger = 6
+    // Inputs below this size index their hash table with 16-bit positions.
+    lz4Limit64K = 64*1024 + lz4MFLimit - 1
+)
+
+var errCorruptLZ4 = errors.New("Corrupt LZ4 block")
+
+func lz4Read16(b []byte, i int) uint16 {
+    return binary.LittleEndian.Uint16(b[i:])
+}
+
+func lz4Read32(b []byte, i int) uint32 {
+    return binary.LittleEndian.Uint32(b[i:])
+}
+
+// lz4Count returns the number of equal bytes at i and match, stopping at
+// limit.
+func lz4Count(b []byte, i, match, limit int) int {
+    n := 0
+    for i+n < limit && b[i+n] == b[match+n] {
+        n++
+    }
+    return n
+}
+
+func lz4CompressBound(n int) int {
+    return n + n/255 + 16
+}
+
+// lz4Decompress decodes the first size bytes of the LZ4 block in src.
+func lz4Decompress(src []byte, size int) ([]byte, error) {
+    // Every byte of a block stands for at most 255 bytes of data.
+    if uint64(size) > uint64(len(src))*255 {
+        return nil, errCorruptLZ4
+    }
+    out := make([]byte, 0, size)
+    i := 0
+    readLength := func(n int) (int, error) {
+        for {
+            if i >= len(src) {
+                return 0, errCorruptLZ4
+            }
+            b := src[i]
+            i++
+            n += int(b)
+            if b != 255 {
+                return n, nil
+            }
+        }
+    }
+
+    for len(out) < size {
+        if i >= len(src) {
+            return nil, errCorruptLZ4
+        }
+        token := src[i]
+        i++
+
+        literals := int(token >> lz4MLBits)
+        if literals == lz4RunMask {
+            var err error
+            if literals, err = readLength(literals); err != nil {
+                return nil, err
+            }
+        }
+        if literals > len(src)-i {
+            return nil, errCorruptLZ4
+        }
+        if literals > size-len(out) {
+            literals = size - len(out)
+        }
+        out = append(out, src[i:i+literals]...)
+        i += literals
+        if len(out) == size {
+            break
+        }
+
+        if len(src)-i < 2 {
+            return nil, errCorruptLZ4
+        }
+        offset := int(lz4Read16(src, i))
+        i += 2
+        if offset == 0 || offset > len(out) {
+            return nil, errCorruptLZ4
+        }
+        length := int(token & lz4MLMask)
+        if length == lz4MLMask {
+            var err error
+            if length, err = readLength(length); err != nil {
+                return nil, err
+            }
+        }
+        length += lz4MinMatch
+        if length > size-len(out) {
+            length = size - len(out)
+        }
+        for ; length > 0; length-- {
+            out = append(out, out[len(out)-offset])
+        }
+    }
+    return out, nil
+}
+
+// lz4WriteLength writes the extra bytes of a literal or match length that
+// did not fit in its token.
+func lz4WriteLength(dst []byte, op int, n int) int {
+    for ; n >= 255; n -= 255 {
+        dst[op] = 255
+        op++
+    }
+    dst[op] = byte(n)
+    return op + 1
+}
+
+// lz4WriteLastLiterals writes the final literal run of a block.
+func lz4WriteLastLiterals(dst []byte, op int, literals []byte) int {
+    if len(literals) >= lz4RunMask {
+        dst[op] = lz4RunMask << lz4MLBits
+        op = lz4WriteLength(dst, op+1, len(literals)-lz4RunMask)
+    } else {
+        dst[op] = byte(len(literals) << lz4MLBits)
+        op++
+    }
+    return op + copy(dst[op:], literals)
+}
+
+// lz4CompressDestSize compresses as much of src as fits in target bytes,
+// like LZ4_compress_destSize. It returns the block and the number of bytes
+// of src it holds.
+func lz4CompressDestSize(src []byte, target int) ([]byte, int) {
+    if target >= lz4CompressBound(len(src)) {
+        return lz4Compress(src, target, false)
+    }
+    return lz4Compress(src, target, true)
+}
+
+// lz4Compress is LZ4_compress_generic with acceleration 1 and no
+// dictionary. If fill is set the output is limited to target bytes and only
+// part of src may be compressed.
+func lz4Compress(src []byte, target int, fill bool) ([]byte, int) {
+    if fill && target < 1 {
+        return nil, 0
+    }
+
+    byU16 := len(src) < lz4Limit64K
+    hash := func(p int) uint32 {
+        if byU16 {
+            return (lz4Read32(src, p) * 2654435761) >> (32 - (lz4HashLog + 1))
+        }
+        return uint32(((binary.LittleEndian.Uint64(src[p:]) << 24) * 889523592379) >> (64 - lz4HashLog))
+    }
+    var table [1 << (lz4HashLog + 1)]uint32
+
+    dst := make([]byte, target)
+    iend := len(src)
+    mflimitPlusOne := iend - lz4MFLimit + 1
+    matchlimit := iend - lz4LastLiterals
+    ip, anchor, op := 0, 0, 0
+    var match, token, filledIP int
+    var forwardH uint32
+
+    if len(src) < lz4MinLength {
+        goto lastLiterals
+    }
+
+    table[hash(ip)] = uint32(ip)
+    ip++
+    forwardH = hash(ip)
+
+    for {
+        {
+            // Find a match, skipping faster the longer none is found.
+            forwardIP := ip
+            step := 1
+            searchMatchNb := 1 << lz4SkipTrigger
+            for {
+                h := forwardH
+                current := forwardIP
+                matchIndex := int(table[h])
+                ip = forwardIP
+                forwardIP += step
+                step = searchMatchNb >> lz4SkipTrigger
+                searchMatchNb++
+                if forwardIP > mflimitPlusOne {
+                    goto lastLiterals
+                }
+                match = matchIndex
+                forwardH = hash(forwardIP)
+                table[h] = uint32(current)
+                if !byU16 && matchIndex+lz4DistanceMax < current {
+                    continue
+                }
+                if lz4Read32(src, match) == lz4Read32(src, ip) {
+                    break
+                }
+            }
+
+            filledIP = ip
+            for ip > anchor && match > 0 && src[ip-1] == src[match-1] {
+                ip--
+                match--
+            }
+
+            litLength := ip - anchor
+            token = op
+            op++
+            if fill && op+(litLength+240)/255+litLength+2+1+lz4MFLimit-lz4MinMatch > target {
+                op--
+                goto lastLiterals
+            }
+            if litLength >= lz4RunMask {
+                dst[token] = lz4RunMask << lz4MLBits
+                op = lz4WriteLength(dst, op, litLength-lz4RunMask)
+            } else {
+                dst[token] = byte(litLength << lz4MLBits)
+            }
+            op += copy(dst[op:], src[anchor:ip])
+        }
+
+    nextMatch:
+        if fill && op+2+1+lz4MFLimit-lz4MinMatch > target {
+            op = token
+            goto lastLiterals
+        }
+        binary.LittleEndian.PutUint16(dst[op:], uint16(ip-match))
+        op += 2
+
+        {
+            matchCode := lz4Count(src, ip+lz4MinMatch, match+lz4MinMatch, matchlimit)
+            ip += matchCode + lz4MinMatch
+            if fill && op+1+lz4LastLiterals+(matchCode+240)/255 > target {
+                // The match is too long for the space left, shorten it.
+                newMatchCode := 15 - 1 + (target-op-1-lz4LastLiterals)*255
+                ip -= matchCode - newMatchCode
+                matchCode = newMatchCode
+                if ip <= filledIP {
+                    for p := ip; p <= filledIP; p++ {
+                        table[hash(p)] = 0
+                    }
+                }
+            }
+            if matchCode >= lz4MLMask {
+                dst[token] += lz4MLMask
+                op = lz4WriteLength(dst, op, matchCode-lz4MLMask)
+            } else {
+                dst[token] += byte(matchCode)
+            }
+        }
+
+        anchor = ip
+        if ip >= mflimitPlusOne {
+            break
+        }
+        table[hash(ip-2)] = uint32(ip - 2)
+
+        {
+            // Try to start another match right away.
+            h := hash(ip)
+            current := ip
+            matchIndex := int(table[h])
+            match = matchIndex
+            table[h] = uint32(current)
+            if (byU16 || matchIndex+lz4DistanceMax >= current) && lz4Read32(src, match) == lz4Read32(src, ip) {
+                token = op
+                op++
+                dst[token] = 0
+                goto nextMatch
+            }
+        }
+
+        ip++
+        forwardH = hash(ip)
+    }
+
+lastLiterals:
+    lastRun := iend - anchor
+    if fill && op+lastRun+1+(lastRun+255-lz4RunMask)/255 > target {
+        lastRun = target - op - 1
+        lastRun -= (lastRun + 256 - lz4RunMask) / 256
+    }
+    op = lz4WriteLastLiterals(dst, op, src[anchor:anchor+lastRun])
+    return dst[:op], anchor + lastRun
+}
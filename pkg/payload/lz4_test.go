@@ -0,0 +1,89 @@
+package payload
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "testing"
+)
+
+// lz4TestData returns n bytes of repetitive text.
+func lz4TestData(n int) []byte {
+    words := []string{"payload", "dumper", "update", "engine", "block", "\x00\x00\x00\x00", "lz4", " ", "\n", "extent"}
+    var b []byte
+    x := uint32(1)
+    for len(b) < n {
+        x = x*1103515245 + 12345
+        b = append(b, words[(x>>16)%uint32(len(words))]...)
+    }
+    return b[:n]
+}
+
+// The expected blocks were produced by LZ4_compress_destSize and
+// LZ4_compress_HC_destSize of liblz4 1.9.4. Level -1 is the fast compressor.
+func TestLZ4CompressGolden(t *testing.T) {
+    data := lz4TestData(20000)
+    tests := []struct {
+        level    int
+        target   int
+        consumed int
+        size     int
+        sha256   string
+    }{
+        {-1, 4096, 8650, 4096, "64651cd437a3756ef96e8a741ef0e7accc7ae6ea4398955f81c2eb708bbe8359"},
+        {-1, 100000, 20000, 9319, "865d7ba28e948f8d7b96c2526b27e3d5f3d5753d247fb59bce62df03e5b72789"},
+        {1, 4096, 14359, 4096, "3fde4cdba2d36e7784d6aa043cdba839c718b81c493efd6f19cb70a3da3e4eb0"},
+        {9, 4096, 16542, 4096, "28c254a7295332d911ecdeeb15d459d84be41d6aa77c6bc4f41851c56147a28c"},
+        {9, 100000, 20000, 4845, "fcfa5f9c21c56e732d6ff9d14be7afc490b112cc5f09db979df900d272f354fd"},
+        {10, 4096, 17201, 4096, "5f841a1503c1e3d87df8a18d83a15910936dce475d6e7f5150f7606624f9d86a"},
+        {12, 4096, 17372, 4096, "12463888336c1f6696293084cf375f67cb2dfe880d925f0cf6ac94371658fc30"},
+    }
+    for _, test := range tests {
+        var block []byte
+        var consumed int
+        if test.level < 0 {
+            block, consumed = lz4CompressDestSize(data, test.target)
+        } else {
+            block, consumed = lz4hcCompressDestSize(data, test.target, test.level)
+        }
+        hash := sha256.Sum256(block)
+        if consumed != test.consumed || len(block) != test.size || hex.EncodeToString(hash[:]) != test.sha256 {
+            t.Errorf("level %d, target %d: got %d bytes from %d (%x)", test.level, test.target, len(block), consumed, hash)
+            continue
+        }
+        out, err := lz4Decompress(block, consumed)
+        if err != nil || !bytes.Equal(out, data[:consumed]) {
+            t.Errorf("level %d, target %d: does not decompress: %v", test.level, test.target, err)
+        }
+    }
+}
+
+func TestLZ4CompressSmall(t *testing.T) {
+    data := []byte("abcabcabcabcabcabcabcabcabc_xyz_abcabcabc")
+    want, _ := hex.DecodeString("3f616263030005e05f78797a5f616263616263616263")
+    if block, n := lz4CompressDestSize(data, 64); n != len(data) || !bytes.Equal(block, want) {
+        t.Errorf("fast: got %x from %d bytes", block, n)
+    }
+    if block, n := lz4hcCompressDestSize(data, 64, 9); n != len(data) || !bytes.Equal(block, want) {
+        t.Errorf("hc: got %x from %d bytes", block, n)
+    }
+    // Only 39 bytes fit in 20.
+    want, _ = hex.DecodeString("3f616263030005c05f78797a5f61626361626361")
+    if block, n := lz4hcCompressDestSize(data, 20, 9); n != 39 || !bytes.Equal(block, want) {
+        t.Errorf("hc, 20 bytes: got %x from %d bytes", block, n)
+    }
+}
+
+func TestLZ4DecompressCorrupt(t *testing.T) {
+    for _, block := range [][]byte{
+        {},
+        {0x40, 'a'},
+        {0x10, 'a', 0x02, 0x00},
+        {0x10, 'a', 0x00, 0x00},
+        {0xF0, 0xFF},
+    } {
+        if _, err := lz4Decompress(block, 8); err == nil {
+            t.Errorf("expected an error for %x", block)
+        }
+    }
+}
@@ -0,0 +1,333 @@
+package payload
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "math"
+
+    "google.golang.org/protobuf/encoding/protowire"
+)
+
+// This file applies LZ4DIFF patches, which update_engine uses for files
+// compressed in LZ4 blocks, such as those of EROFS images. The source blocks
+// are decompressed, the inner bsdiff or puffdiff patch is applied to the
+// result, and the patched data is compressed again block by block with the
+// algorithm recorded in the patch. Blocks the device compresses differently
+// are corrected by a bsdiff patch of their own.
+
+const (
+    lz4diffMagic = "LZ4DIFF"
+    lz4diffVersion = 1
+    // The magic, version and size of the protobuf header, padded to 16
+    // bytes.
+    lz4diffHeaderSize = 16
+)
+
+// Inner patch types of chromeos_update_engine.Lz4diffHeader.
+const (
+    lz4diffInnerBsdiff = 0
+    lz4diffInnerPuffdiff = 1
+)
+
+// Compression types of chromeos_update_engine.CompressionAlgorithm.
+const (
+    lz4diffUncompressed = 0
+    lz4diffLZ4 = 1
+    lz4diffLZ4HC = 2
+)
+
+var errCorruptLz4diffPatch = errors.New("Corrupt LZ4DIFF patch")
+
+// lz4diffBlock is a block of a compressed file, the unit that is
+// decompressed and compressed at once.
+type lz4diffBlock struct {
+    uncompressedOffset uint64
+    uncompressedLength uint64
+    compressedLength uint64
+    sha256Hash []byte
+    postfixBspatch []byte
+}
+
+func (b *lz4diffBlock) compressed() bool {
+    return b.compressedLength < b.uncompressedLength
+}
+
+// lz4diffFile describes how a file is split into compressed blocks.
+type lz4diffFile struct {
+    blocks []*lz4diffBlock
+    algorithm uint64
+    level int
+    zeroPadding bool
+}
+
+func parseLz4diffBlock(b []byte) (*lz4diffBlock, error) {
+    block := &lz4diffBlock{}
+    err := consumeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+        switch {
+        case num >= 1 && num <= 3 && typ == protowire.VarintType:
+            v, n := protowire.ConsumeVarint(b)
+            switch num {
+            case 1:
+                block.uncompressedOffset = v
+            case 2:
+                block.uncompressedLength = v
+            case 3:
+                block.compressedLength = v
+            }
+            return n, nil
+        case (num == 4 || num == 5) && typ == protowire.BytesType:
+            v, n := protowire.ConsumeBytes(b)
+            if num == 4 {
+                block.sha256Hash = v
+            } else {
+                block.postfixBspatch = v
+            }
+            return n, nil
+        }
+        return 0, nil
+    })
+    return block, err
+}
+
+func parseLz4diffFile(b []byte) (*lz4diffFile, error) {
+    file := &lz4diffFile{}
+    err := consumeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+        switch {
+        case num == 1 && typ == protowire.BytesType:
+            v, n := protowire.ConsumeBytes(b)
+            if n < 0 {
+                return n, nil
+            }
+            block, err := parseLz4diffBlock(v)
+            file.blocks = append(file.blocks, block)
+            return n, err
+        case num == 2 && typ == protowire.BytesType:
+            v, n := protowire.ConsumeBytes(b)
+            if n < 0 {
+                return n, nil
+            }
+            return n, consumeMessage(v, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+                if typ != protowire.VarintType || (num != 1 && num != 2) {
+                    return 0, nil
+                }
+                v, n := protowire.ConsumeVarint(b)
+                if num == 1 {
+                    file.algorithm = v
+                } else {
+                    file.level = int(int32(v))
+                }
+                return n, nil
+            })
+        case num == 3 && typ == protowire.VarintType:
+            v, n := protowire.ConsumeVarint(b)
+            file.zeroPadding = protowire.DecodeBool(v)
+            return n, nil
+        }
+        return 0, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    // Blocks cover the uncompressed file in order, without gaps. Their
+    // sizes are limited like the int sizes of liblz4.
+    var offset uint64
+    for _, block := range file.blocks {
+        if block.uncompressedOffset != offset ||
+            block.uncompressedLength > math.MaxInt32 || block.compressedLength > math.MaxInt32 ||
+            (!block.compressed() && block.compressedLength != block.uncompressedLength) {
+            return nil, errCorruptLz4diffPatch
+        }
+        offset += block.uncompressedLength
+    }
+    return file, nil
+}
+
+// parseLz4diffPatch splits an LZ4DIFF patch into the source and destination
+// files, the inner patch type and the inner patch.
+func parseLz4diffPatch(patch []byte) (src *lz4diffFile, dst *lz4diffFile, innerType uint64, inner []byte, err error) {
+    if len(patch) < lz4diffHeaderSize {
+        return nil, nil, 0, nil, errCorruptLz4diffPatch
+    }
+    if string(patch[:len(lz4diffMagic)]) != lz4diffMagic {
+        return nil, nil, 0, nil, fmt.Errorf("Invalid LZ4DIFF magic: %q", patch[:len(lz4diffMagic)])
+    }
+    // update_engine writes the version and header size right after the
+    // seven characters of the magic. They are also accepted after the NUL
+    // that ends it.
+    fields := patch[len(lz4diffMagic):]
+    if binary.BigEndian.Uint32(fields) != lz4diffVersion && fields[0] == 0 {
+        fields = fields[1:]
+    }
+    if version := binary.BigEndian.Uint32(fields); version != lz4diffVersion {
+        return nil, nil, 0, nil, fmt.Errorf("Unsupported LZ4DIFF version: %d", version)
+    }
+    headerSize := uint64(binary.BigEndian.Uint32(fields[4:]))
+    patch = patch[lz4diffHeaderSize:]
+    if headerSize > uint64(len(patch)) {
+        return nil, nil, 0, nil, errCorruptLz4diffPatch
+    }
+
+    err = consumeMessage(patch[:headerSize], func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+        switch {
+        case (num == 1 || num == 2) && typ == protowire.BytesType:
+            v, n := protowire.ConsumeBytes(b)
+            if n < 0 {
+                return n, nil
+            }
+            file, err := parseLz4diffFile(v)
+            if num == 1 {
+                src = file
+            } else {
+                dst = file
+            }
+            return n, err
+        case num == 3 && typ == protowire.VarintType:
+            v, n := protowire.ConsumeVarint(b)
+            innerType = v
+            return n, nil
+        }
+        return 0, nil
+    })
+    if err != nil {
+        return nil, nil, 0, nil, err
+    }
+    if src == nil {
+        src = &lz4diffFile{}
+    }
+    if dst == nil {
+        dst = &lz4diffFile{}
+    }
+    return src, dst, innerType, patch[headerSize:], nil
+}
+
+// decompress returns the uncompressed contents of the file in data. Data
+// after the last block is kept as is.
+func (f *lz4diffFile) decompress(ctx context.Context, data []byte) ([]byte, error) {
+    var out []byte
+    var offset uint64
+    for _, block := range f.blocks {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        if block.compressedLength > uint64(len(data))-offset {
+            return nil, errCorruptLz4diffPatch
+        }
+        compressed := data[offset : offset+block.compressedLength]
+        offset += block.compressedLength
+        if !block.compressed() {
+            out = append(out, compressed...)
+            continue
+        }
+        if f.zeroPadding {
+            // The compressed data is aligned to the end of the block.
+            compressed = bytes.TrimLeft(compressed, "\x00")
+        }
+        uncompressed, err := lz4Decompress(compressed, int(block.uncompressedLength))
+        if err != nil {
+            return nil, err
+        }
+        out = append(out, uncompressed...)
+    }
+    return append(out, data[offset:]...), nil
+}
+
+// compress compresses the uncompressed contents of the file in data, checks
+// the blocks against their hashes and applies their postfix patches. Data
+// after the last block is kept as is.
+func (f *lz4diffFile) compress(ctx context.Context, data []byte) ([]byte, error) {
+    var out []byte
+    var offset uint64
+    for i, block := range f.blocks {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        if block.uncompressedLength > uint64(len(data))-offset {
+            return nil, errCorruptLz4diffPatch
+        }
+        uncompressed := data[offset : offset+block.uncompressedLength]
+        offset += block.uncompressedLength
+
+        compressed := uncompressed
+        if block.compressed() {
+            var lz4 []byte
+            var n int
+            switch f.algorithm {
+            case lz4diffLZ4:
+                lz4, n = lz4CompressDestSize(uncompressed, int(block.compressedLength))
+            case lz4diffLZ4HC:
+                lz4, n = lz4hcCompressDestSize(uncompressed, int(block.compressedLength), f.level)
+            default:
+                return nil, fmt.Errorf("Unsupported LZ4DIFF compression type: %d", f.algorithm)
+            }
+            if n != len(uncompressed) {
+                return nil, fmt.Errorf("LZ4DIFF block %d does not fit in %d bytes", i, block.compressedLength)
+            }
+            compressed = make([]byte, block.compressedLength)
+            if f.zeroPadding {
+                copy(compressed[len(compressed)-len(lz4):], lz4)
+            } else {
+                copy(compressed, lz4)
+            }
+        }
+
+        if len(block.sha256Hash) != 0 {
+            if hash := sha256.Sum256(compressed); !bytes.Equal(hash[:], block.sha256Hash) {
+                return nil, fmt.Errorf("LZ4DIFF block %d was compressed differently than expected", i)
+            }
+        }
+        if len(block.postfixBspatch) != 0 {
+            var err error
+            if compressed, err = bspatch(ctx, compressed, block.postfixBspatch, int64(block.compressedLength)); err != nil {
+                return nil, err
+            }
+        }
+        out = append(out, compressed...)
+    }
+    return append(out, data[offset:]...), nil
+}
+
+// lz4diffpatch applies an LZ4DIFF patch to old and returns the new data,
+// which may not be larger than limit. It stops with ctx.Err() once ctx is
+// done.
+func lz4diffpatch(ctx context.Context, old []byte, patch []byte, limit int64) ([]byte, error) {
+    src, dst, innerType, inner, err := parseLz4diffPatch(patch)
+    if err != nil {
+        return nil, err
+    }
+
+    // The inner patch produces the uncompressed destination, which differs
+    // in size from the new data by what its blocks save.
+    var compressedSize, uncompressedSize int64
+    for _, block := range dst.blocks {
+        compressedSize += int64(block.compressedLength)
+        uncompressedSize += int64(block.uncompressedLength)
+    }
+    if compressedSize > limit {
+        return nil, fmt.Errorf("Patched data is too large: %d > %d", compressedSize, limit)
+    }
+    innerLimit := limit - compressedSize + uncompressedSize
+
+    apply := bspatch
+    switch innerType {
+    case lz4diffInnerBsdiff:
+    case lz4diffInnerPuffdiff:
+        apply = puffpatch
+    default:
+        return nil, fmt.Errorf("Unsupported LZ4DIFF inner patch type: %d", innerType)
+    }
+
+    uncompressed, err := src.decompress(ctx, old)
+    if err != nil {
+        return nil, err
+    }
+    patched, err := apply(ctx, uncompressed, inner, innerLimit)
+    if err != nil {
+        return nil, err
+    }
+    return dst.compress(ctx, patched)
+}
@@ -0,0 +1,180 @@
+package payload
+
+import (
+    "bytes"
+    "context"
+    "crypto/sha256"
+    "encoding/binary"
+    "strings"
+    "testing"
+
+    "google.golang.org/protobuf/encoding/protowire"
+)
+
+// bsdf2Patch builds an uncompressed BSDF2 patch from old to newData.
+func bsdf2Patch(old, newData []byte) []byte {
+    le := func(v int) []byte {
+        b := make([]byte, 8)
+        binary.LittleEndian.PutUint64(b, uint64(v))
+        return b
+    }
+    ctrl := concat(le(len(newData)), le(0), le(0))
+    diff := make([]byte, len(newData))
+    for i := range diff {
+        diff[i] = newData[i] - old[i]
+    }
+    return concat([]byte("BSDF2\x00\x00\x00"), le(len(ctrl)), le(len(diff)), le(len(newData)), ctrl, diff)
+}
+
+func appendLz4diffFile(b []byte, num protowire.Number, f *lz4diffFile) []byte {
+    var file []byte
+    for _, block := range f.blocks {
+        var m []byte
+        m = protowire.AppendTag(m, 1, protowire.VarintType)
+        m = protowire.AppendVarint(m, block.uncompressedOffset)
+        m = protowire.AppendTag(m, 2, protowire.VarintType)
+        m = protowire.AppendVarint(m, block.uncompressedLength)
+        m = protowire.AppendTag(m, 3, protowire.VarintType)
+        m = protowire.AppendVarint(m, block.compressedLength)
+        if block.sha256Hash != nil {
+            m = protowire.AppendTag(m, 4, protowire.BytesType)
+            m = protowire.AppendBytes(m, block.sha256Hash)
+        }
+        if block.postfixBspatch != nil {
+            m = protowire.AppendTag(m, 5, protowire.BytesType)
+            m = protowire.AppendBytes(m, block.postfixBspatch)
+        }
+        file = protowire.AppendTag(file, 1, protowire.BytesType)
+        file = protowire.AppendBytes(file, m)
+    }
+    var algo []byte
+    algo = protowire.AppendTag(algo, 1, protowire.VarintType)
+    algo = protowire.AppendVarint(algo, f.algorithm)
+    algo = protowire.AppendTag(algo, 2, protowire.VarintType)
+    algo = protowire.AppendVarint(algo, uint64(f.level))
+    file = protowire.AppendTag(file, 2, protowire.BytesType)
+    file = protowire.AppendBytes(file, algo)
+    file = protowire.AppendTag(file, 3, protowire.VarintType)
+    file = protowire.AppendVarint(file, protowire.EncodeBool(f.zeroPadding))
+
+    b = protowire.AppendTag(b, num, protowire.BytesType)
+    return protowire.AppendBytes(b, file)
+}
+
+func lz4diffTestPatch(src, dst *lz4diffFile, inner []byte) []byte {
+    var header []byte
+    header = appendLz4diffFile(header, 1, src)
+    header = appendLz4diffFile(header, 2, dst)
+    header = protowire.AppendTag(header, 3, protowire.VarintType)
+    header = protowire.AppendVarint(header, lz4diffInnerBsdiff)
+
+    patch := make([]byte, lz4diffHeaderSize)
+    copy(patch, lz4diffMagic)
+    binary.BigEndian.PutUint32(patch[len(lz4diffMagic):], lz4diffVersion)
+    binary.BigEndian.PutUint32(patch[len(lz4diffMagic)+4:], uint32(len(header)))
+    return concat(patch, header, inner)
+}
+
+// lz4diffTestFile splits data into blocks of 3000 bytes, compresses all but
+// the second one into blocks of 2048 bytes and returns the compressed data.
+func lz4diffTestFile(t *testing.T, data []byte, algorithm uint64, zeroPadding bool) (*lz4diffFile, []byte) {
+    f := &lz4diffFile{algorithm: algorithm, level: 9, zeroPadding: zeroPadding}
+    var out []byte
+    for i := 0; i < len(data); i += 3000 {
+        uncompressed := data[i : i+3000]
+        block := &lz4diffBlock{uncompressedOffset: uint64(i), uncompressedLength: 3000, compressedLength: 3000}
+        compressed := uncompressed
+        if i != 3000 {
+            var lz4 []byte
+            var n int
+            if algorithm == lz4diffLZ4 {
+                lz4, n = lz4CompressDestSize(uncompressed, 2048)
+            } else {
+                lz4, n = lz4hcCompressDestSize(uncompressed, 2048, 9)
+            }
+            if n != len(uncompressed) {
+                t.Fatalf("block %d does not fit", i/3000)
+            }
+            block.compressedLength = 2048
+            compressed = make([]byte, 2048)
+            if zeroPadding {
+                copy(compressed[2048-len(lz4):], lz4)
+            } else {
+                copy(compressed, lz4)
+            }
+        }
+        hash := sha256.Sum256(compressed)
+        block.sha256Hash = hash[:]
+        f.blocks = append(f.blocks, block)
+        out = append(out, compressed...)
+    }
+    return f, out
+}
+
+func TestLz4diffPatch(t *testing.T) {
+    oldData := lz4TestData(9000)
+    newData := append([]byte(nil), oldData...)
+    copy(newData[100:], "changed")
+    copy(newData[4000:], "changed too")
+    copy(newData[8990:], "0123456789")
+    oldTail, newTail := []byte("old tail"), []byte("new tail")
+
+    for _, algorithm := range []uint64{lz4diffLZ4, lz4diffLZ4HC} {
+        for _, zeroPadding := range []bool{false, true} {
+            src, old := lz4diffTestFile(t, oldData, algorithm, zeroPadding)
+            dst, want := lz4diffTestFile(t, newData, algorithm, zeroPadding)
+            old = append(old, oldTail...)
+            want = append(want, newTail...)
+
+            inner := bsdf2Patch(append(oldData, oldTail...), append(newData, newTail...))
+            patch := lz4diffTestPatch(src, dst, inner)
+            got, err := lz4diffpatch(context.Background(), old, patch, int64(len(want)))
+            if err != nil {
+                t.Fatalf("algorithm %d, zero padding %v: %v", algorithm, zeroPadding, err)
+            }
+            if !bytes.Equal(got, want) {
+                t.Fatalf("algorithm %d, zero padding %v: wrong output", algorithm, zeroPadding)
+            }
+
+            if _, err := lz4diffpatch(context.Background(), old, patch, int64(len(want))-1); err == nil {
+                t.Fatal("expected an error for output larger than the limit")
+            }
+        }
+    }
+}
+
+func TestLz4diffPatchPostfix(t *testing.T) {
+    data := lz4TestData(6000)
+    src, old := lz4diffTestFile(t, data, lz4diffLZ4HC, true)
+    dst, want := lz4diffTestFile(t, data, lz4diffLZ4HC, true)
+
+    // The postfix patch replaces the recompressed block, for devices that
+    // compress it differently.
+    fixed := bytes.Repeat([]byte{0xAA}, 2048)
+    dst.blocks[0].postfixBspatch = bsdf2Patch(want[:2048], fixed)
+    copy(want, fixed)
+
+    patch := lz4diffTestPatch(src, dst, bsdf2Patch(data, data))
+    got, err := lz4diffpatch(context.Background(), old, patch, int64(len(want)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, want) {
+        t.Fatal("postfix patch was not applied")
+    }
+
+    dst.blocks[1].sha256Hash = make([]byte, sha256.Size)
+    patch = lz4diffTestPatch(src, dst, bsdf2Patch(data, data))
+    _, err = lz4diffpatch(context.Background(), old, patch, int64(len(want)))
+    if err == nil || !strings.Contains(err.Error(), "block 1") {
+        t.Fatalf("got %v, want an error for the hash of block 1", err)
+    }
+}
+
+func TestParseLz4diffPatchShort(t *testing.T) {
+    for _, patch := range [][]byte{nil, []byte("LZ4DIFF"), []byte("LZ4DIFF\x00\x00\x00\x00\x02\x00\x00\x00\x00\x00")} {
+        if _, _, _, _, err := parseLz4diffPatch(patch); err == nil {
+            t.Fatalf("expected an error for %q", patch)
+        }
+    }
+}
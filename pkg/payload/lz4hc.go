@@ -0,0 +1,710 @@
+package payload
+
+import (
+    "encoding/binary"
+)
+
+// This file implements LZ4HC, the high compression LZ4 encoder, following
+// liblz4 1.9.4. Levels up to 9 search hash chains, levels 10 to 12 use the
+// optimal parser.
+
+const (
+    lz4hcHashLog = 15
+    lz4hcMaxD = 1 << 16
+    lz4hcClevelDefault = 9
+    lz4hcClevelMax = 12
+    lz4hcOptimalML = lz4MLMask - 1 + lz4MinMatch
+    lz4OptNum = 1 << 12
+    lz4TrailingLiterals = 3
+
+    // Positions are indexed from lz4hcBase, so that the zeroed tables point
+    // before the start of the input.
+    lz4hcBase = 64 * 1024
+)
+
+var lz4hcLevels = [lz4hcClevelMax + 1]struct {
+    optimal bool
+    nbSearches int
+    targetLength int
+}{
+    {false, 2, 16},
+    {false, 2, 16},
+    {false, 2, 16},
+    {false, 4, 16},
+    {false, 8, 16},
+    {false, 16, 16},
+    {false, 32, 16},
+    {false, 64, 16},
+    {false, 128, 16},
+    {false, 256, 16},
+    {true, 96, 64},
+    {true, 512, 128},
+    {true, 16384, lz4OptNum},
+}
+
+type lz4hcState struct {
+    src []byte
+    dst []byte
+    hashTable [1 << lz4hcHashLog]uint32
+    chainTable [lz4hcMaxD]uint16
+    nextToUpdate uint32
+}
+
+func (s *lz4hcState) hash(p int) uint32 {
+    return (lz4Read32(s.src, p) * 2654435761) >> (32 - lz4hcHashLog)
+}
+
+// insert adds the positions up to ip to the hash chains.
+func (s *lz4hcState) insert(ip int) {
+    target := uint32(ip) + lz4hcBase
+    for idx := s.nextToUpdate; idx < target; idx++ {
+        h := s.hash(int(idx - lz4hcBase))
+        delta := idx - s.hashTable[h]
+        if delta > lz4DistanceMax {
+            delta = lz4DistanceMax
+        }
+        s.chainTable[uint16(idx)] = uint16(delta)
+        s.hashTable[h] = idx
+    }
+    s.nextToUpdate = target
+}
+
+// lz4hcCountPattern counts the bytes from ip that repeat the 4 byte pattern.
+func lz4hcCountPattern(b []byte, ip, end int, pattern uint32) int {
+    n := 0
+    for ip+n < end && b[ip+n] == byte(pattern>>(8*(n&3))) {
+        n++
+    }
+    return n
+}
+
+// lz4hcReverseCountPattern counts the bytes before ip, down to low, that
+// repeat the 4 byte pattern.
+func lz4hcReverseCountPattern(b []byte, ip, low int, pattern uint32) int {
+    start := ip
+    for ip >= low+4 && lz4Read32(b, ip-4) == pattern {
+        ip -= 4
+    }
+    for i := 3; ip > low && b[ip-1] == byte(pattern>>(8*i)); i-- {
+        ip--
+    }
+    return start - ip
+}
+
+// lz4hcProtectDictEnd reports whether matchIndex is at least 4 bytes before
+// the end of the dictionary, or after it.
+func lz4hcProtectDictEnd(dictLimit, matchIndex uint32) bool {
+    return dictLimit-1-matchIndex >= 3
+}
+
+const (
+    lz4hcRepeatUntested = iota
+    lz4hcRepeatNot
+    lz4hcRepeatConfirmed
+)
+
+// insertAndGetWiderMatch looks for a match at ip longer than longest, which
+// may start as far back as lowLimit. It returns the length of the match
+// found, or longest, and sets matchPos and startPos for a longer match.
+func (s *lz4hcState) insertAndGetWiderMatch(ip, lowLimit, highLimit, longest int, matchPos, startPos *int, maxNbAttempts int, patternAnalysis, chainSwap bool) int {
+    src := s.src
+    const prefixIdx = lz4hcBase
+    ipIndex := uint32(ip) + prefixIdx
+    lowestMatchIndex := uint32(prefixIdx)
+    if prefixIdx+lz4DistanceMax+1 <= ipIndex {
+        lowestMatchIndex = ipIndex - lz4DistanceMax
+    }
+    lookBackLength := ip - lowLimit
+    nbAttempts := maxNbAttempts
+    matchChainPos := uint32(0)
+    pattern := lz4Read32(src, ip)
+    repeat := lz4hcRepeatUntested
+    srcPatternLength := 0
+
+    s.insert(ip)
+    matchIndex := s.hashTable[s.hash(ip)]
+
+    for matchIndex >= lowestMatchIndex && nbAttempts > 0 {
+        matchLength := 0
+        nbAttempts--
+        match := int(matchIndex - prefixIdx)
+        if lz4Read16(src, lowLimit+longest-1) == lz4Read16(src, match-lookBackLength+longest-1) &&
+            lz4Read32(src, match) == pattern {
+            back := 0
+            if lookBackLength > 0 {
+                // Extend the match backwards, not before lowLimit or the
+                // start of the input.
+                for back > lowLimit-ip && back > -match && src[ip+back-1] == src[match+back-1] {
+                    back--
+                }
+            }
+            matchLength = lz4MinMatch + lz4Count(src, ip+lz4MinMatch, match+lz4MinMatch, highLimit)
+            matchLength -= back
+            if matchLength > longest {
+                longest = matchLength
+                *matchPos = match + back
+                *startPos = ip + back
+            }
+        }
+
+        if chainSwap && matchLength == longest && matchIndex+uint32(longest) <= ipIndex {
+            // Follow the chain of the position in the match that has the
+            // farthest previous occurrence.
+            const kTrigger = 4
+            distanceToNextMatch := uint32(1)
+            end := longest - lz4MinMatch + 1
+            step := 1
+            accel := 1 << kTrigger
+            for pos := 0; pos < end; pos += step {
+                candidateDist := uint32(s.chainTable[uint16(matchIndex+uint32(pos))])
+                step = accel >> kTrigger
+                accel++
+                if candidateDist > distanceToNextMatch {
+                    distanceToNextMatch = candidateDist
+                    matchChainPos = uint32(pos)
+                    accel = 1 << kTrigger
+                }
+            }
+            if distanceToNextMatch > 1 {
+                if distanceToNextMatch > matchIndex {
+                    break
+                }
+                matchIndex -= distanceToNextMatch
+                continue
+            }
+        }
+
+        distNextMatch := uint32(s.chainTable[uint16(matchIndex)])
+        if patternAnalysis && distNextMatch == 1 && matchChainPos == 0 {
+            // The match may be in a run of a repeated pattern, skip to the
+            // position in the run that matches best.
+            matchCandidateIdx := matchIndex - 1
+            if repeat == lz4hcRepeatUntested {
+                if pattern&0xFFFF == pattern>>16 && pattern&0xFF == pattern>>24 {
+                    repeat = lz4hcRepeatConfirmed
+                    srcPatternLength = lz4hcCountPattern(src, ip+4, highLimit, pattern) + 4
+                } else {
+                    repeat = lz4hcRepeatNot
+                }
+            }
+            if repeat == lz4hcRepeatConfirmed && matchCandidateIdx >= lowestMatchIndex &&
+                lz4hcProtectDictEnd(prefixIdx, matchCandidateIdx) {
+                match := int(matchCandidateIdx - prefixIdx)
+                if lz4Read32(src, match) == pattern {
+                    forwardPatternLength := lz4hcCountPattern(src, match+4, highLimit, pattern) + 4
+                    backLength := uint32(lz4hcReverseCountPattern(src, match, 0, pattern))
+                    if matchCandidateIdx-backLength < lowestMatchIndex {
+                        backLength = matchCandidateIdx - lowestMatchIndex
+                    }
+                    currentSegmentLength := int(backLength) + forwardPatternLength
+                    if currentSegmentLength >= srcPatternLength && forwardPatternLength <= srcPatternLength {
+                        newMatchIndex := matchCandidateIdx + uint32(forwardPatternLength) - uint32(srcPatternLength)
+                        if lz4hcProtectDictEnd(prefixIdx, newMatchIndex) {
+                            matchIndex = newMatchIndex
+                        } else {
+                            matchIndex = prefixIdx
+                        }
+                    } else {
+                        newMatchIndex := matchCandidateIdx - backLength
+                        if !lz4hcProtectDictEnd(prefixIdx, newMatchIndex) {
+                            matchIndex = prefixIdx
+                        } else {
+                            matchIndex = newMatchIndex
+                            if lookBackLength == 0 {
+                                maxML := currentSegmentLength
+                                if srcPatternLength < maxML {
+                                    maxML = srcPatternLength
+                                }
+                                if longest < maxML {
+                                    if ipIndex-matchIndex > lz4DistanceMax {
+                                        break
+                                    }
+                                    longest = maxML
+                                    *matchPos = int(matchIndex) - prefixIdx
+                                    *startPos = ip
+                                }
+                                distToNextPattern := uint32(s.chainTable[uint16(matchIndex)])
+                                if distToNextPattern > matchIndex {
+                                    break
+                                }
+                                matchIndex -= distToNextPattern
+                            }
+                        }
+                    }
+                    continue
+                }
+            }
+        }
+
+        matchIndex -= uint32(s.chainTable[uint16(matchIndex+matchChainPos)])
+    }
+    return longest
+}
+
+// encodeSequence writes the literals from anchor to ip and a match of
+// length matchLength at match, then moves ip and anchor past the match. If
+// limit is set and the sequence does not fit before end it returns true.
+func (s *lz4hcState) encodeSequence(ip, op, anchor *int, matchLength, match int, limit bool, end int) bool {
+    dst := s.dst
+    token := *op
+    *op++
+
+    length := *ip - *anchor
+    if limit && *op+length/255+length+2+1+lz4LastLiterals > end {
+        return true
+    }
+    if length >= lz4RunMask {
+        dst[token] = lz4RunMask << lz4MLBits
+        *op = lz4WriteLength(dst, *op, length-lz4RunMask)
+    } else {
+        dst[token] = byte(length << lz4MLBits)
+    }
+    *op += copy(dst[*op:], s.src[*anchor:*ip])
+
+    binary.LittleEndian.PutUint16(dst[*op:], uint16(*ip-match))
+    *op += 2
+
+    length = matchLength - lz4MinMatch
+    if limit && *op+length/255+1+lz4LastLiterals > end {
+        return true
+    }
+    if length >= lz4MLMask {
+        dst[token] += lz4MLMask
+        *op = lz4WriteLength(dst, *op, length-lz4MLMask)
+    } else {
+        dst[token] += byte(length)
+    }
+
+    *ip += matchLength
+    *anchor = *ip
+    return false
+}
+
+// lastLiterals writes the literals from anchor as the end of the block,
+// as many as fit before end. It returns the position in the input after
+// them.
+func (s *lz4hcState) lastLiterals(anchor int, op *int, end int) int {
+    lastRunSize := len(s.src) - anchor
+    llAdd := (lastRunSize + 255 - lz4RunMask) / 255
+    if *op+1+llAdd+lastRunSize > end {
+        lastRunSize = end - *op - 1
+        llAdd = (lastRunSize + 256 - lz4RunMask) / 256
+        lastRunSize -= llAdd
+    }
+    *op = lz4WriteLastLiterals(s.dst, *op, s.src[anchor:anchor+lastRunSize])
+    return anchor + lastRunSize
+}
+
+// overflow writes as much of the sequence that did not fit as possible
+// before the last literals.
+func (s *lz4hcState) overflow(ip, op, anchor *int, ml, ref int, end int) {
+    ll := *ip - *anchor
+    llTotalCost := 1 + (ll+240)/255 + ll
+    maxLitPos := end - 3
+    if *op+llTotalCost <= maxLitPos {
+        bytesLeftForMl := maxLitPos - (*op + llTotalCost)
+        maxMlSize := lz4MinMatch + lz4MLMask - 1 + bytesLeftForMl*255
+        if ml > maxMlSize {
+            ml = maxMlSize
+        }
+        if end+lz4LastLiterals-(*op+llTotalCost+2)-1+ml >= lz4MFLimit {
+            s.encodeSequence(ip, op, anchor, ml, ref, false, end)
+        }
+    }
+}
+
+// compressHashChain compresses with up to maxNbAttempts hash chain lookups
+// per position, keeping up to three overlapping matches to choose from. It
+// returns the size of the block and the number of input bytes it holds.
+func (s *lz4hcState) compressHashChain(maxNbAttempts int) (int, int) {
+    src := s.src
+    patternAnalysis := maxNbAttempts > 128
+
+    ip, anchor, op := 0, 0, 0
+    iend := len(src)
+    mflimit := iend - lz4MFLimit
+    matchlimit := iend - lz4LastLiterals
+    // The last literals are always kept room for.
+    oend := len(s.dst) - lz4LastLiterals
+
+    var ml, ml0, ml2, ml3 int
+    var start0, ref0, ref, start2, ref2, start3, ref3 int
+    optr := op
+
+    if len(src) < lz4MinLength {
+        goto lastLiterals
+    }
+
+    for ip <= mflimit {
+        ml = s.insertAndGetWiderMatch(ip, ip, matchlimit, lz4MinMatch-1, &ref, new(int), maxNbAttempts, patternAnalysis, false)
+        if ml < lz4MinMatch {
+            ip++
+            continue
+        }
+
+        // Saved, in case we skip too much.
+        start0, ref0, ml0 = ip, ref, ml
+
+    search2:
+        if ip+ml <= mflimit {
+            ml2 = s.insertAndGetWiderMatch(ip+ml-2, ip, matchlimit, ml, &ref2, &start2, maxNbAttempts, patternAnalysis, false)
+        } else {
+            ml2 = ml
+        }
+
+        if ml2 == ml {
+            // No better match, encode the first one.
+            optr = op
+            if s.encodeSequence(&ip, &op, &anchor, ml, ref, true, oend) {
+                goto destOverflow
+            }
+            continue
+        }
+
+        if start0 < ip && start2 < ip+ml0 {
+            // The first match was skipped, squeeze it in again.
+            ip, ref, ml = start0, ref0, ml0
+        }
+
+        if start2-ip < 3 {
+            // The first match is too small, drop it.
+            ml, ip, ref = ml2, start2, ref2
+            goto search2
+        }
+
+    search3:
+        // The second match is at least 3 bytes after the first one.
+        if start2-ip < lz4hcOptimalML {
+            newML := ml
+            if newML > lz4hcOptimalML {
+                newML = lz4hcOptimalML
+            }
+            if ip+newML > start2+ml2-lz4MinMatch {
+                newML = start2 - ip + ml2 - lz4MinMatch
+            }
+            if correction := newML - (start2 - ip); correction > 0 {
+                start2 += correction
+                ref2 += correction
+                ml2 -= correction
+            }
+        }
+
+        if start2+ml2 <= mflimit {
+            ml3 = s.insertAndGetWiderMatch(start2+ml2-3, start2, matchlimit, ml2, &ref3, &start3, maxNbAttempts, patternAnalysis, false)
+        } else {
+            ml3 = ml2
+        }
+
+        if ml3 == ml2 {
+            // No better match, encode the first two.
+            if start2 < ip+ml {
+                ml = start2 - ip
+            }
+            optr = op
+            if s.encodeSequence(&ip, &op, &anchor, ml, ref, true, oend) {
+                goto destOverflow
+            }
+            ip = start2
+            optr = op
+            if s.encodeSequence(&ip, &op, &anchor, ml2, ref2, true, oend) {
+                ml, ref = ml2, ref2
+                goto destOverflow
+            }
+            continue
+        }
+
+        if start3 < ip+ml+3 {
+            // No room for the second match, drop it.
+            if start3 >= ip+ml {
+                // The first match can be written now and the third one
+                // becomes the first.
+                if start2 < ip+ml {
+                    correction := ip + ml - start2
+                    start2 += correction
+                    ref2 += correction
+                    ml2 -= correction
+                    if ml2 < lz4MinMatch {
+                        start2, ref2, ml2 = start3, ref3, ml3
+                    }
+                }
+
+                optr = op
+                if s.encodeSequence(&ip, &op, &anchor, ml, ref, true, oend) {
+                    goto destOverflow
+                }
+                ip, ref, ml = start3, ref3, ml3
+                start0, ref0, ml0 = start2, ref2, ml2
+                goto search2
+            }
+
+            start2, ref2, ml2 = start3, ref3, ml3
+            goto search3
+        }
+
+        // There are three ascending matches, write the first one.
+        if start2 < ip+ml {
+            if start2-ip < lz4hcOptimalML {
+                if ml > lz4hcOptimalML {
+                    ml = lz4hcOptimalML
+                }
+                if ip+ml > start2+ml2-lz4MinMatch {
+                    ml = start2 - ip + ml2 - lz4MinMatch
+                }
+                if correction := ml - (start2 - ip); correction > 0 {
+                    start2 += correction
+                    ref2 += correction
+                    ml2 -= correction
+                }
+            } else {
+                ml = start2 - ip
+            }
+        }
+        optr = op
+        if s.encodeSequence(&ip, &op, &anchor, ml, ref, true, oend) {
+            goto destOverflow
+        }
+
+        ip, ref, ml = start2, ref2, ml2
+        start2, ref2, ml2 = start3, ref3, ml3
+        goto search3
+    }
+
+lastLiterals:
+    ip = s.lastLiterals(anchor, &op, oend+lz4LastLiterals)
+    return op, ip
+
+destOverflow:
+    op = optr
+    s.overflow(&ip, &op, &anchor, ml, ref, oend)
+    goto lastLiterals
+}
+
+type lz4hcOptimal struct {
+    price int
+    off int
+    mlen int
+    litlen int
+}
+
+func lz4hcLiteralsPrice(litlen int) int {
+    price := litlen
+    if litlen >= lz4RunMask {
+        price += 1 + (litlen-lz4RunMask)/255
+    }
+    return price
+}
+
+func lz4hcSequencePrice(litlen, mlen int) int {
+    price := 1 + 2 + lz4hcLiteralsPrice(litlen)
+    if mlen >= lz4MLMask+lz4MinMatch {
+        price += 1 + (mlen-(lz4MLMask+lz4MinMatch))/255
+    }
+    return price
+}
+
+// findLongerMatch returns the length and offset of a match at ip longer than
+// minLen, or zeros.
+func (s *lz4hcState) findLongerMatch(ip, highLimit, minLen, nbSearches int) (int, int) {
+    var match int
+    start := ip
+    length := s.insertAndGetWiderMatch(ip, ip, highLimit, minLen, &match, &start, nbSearches, true, true)
+    if length <= minLen {
+        return 0, 0
+    }
+    return length, start - match
+}
+
+// compressOptimal picks the cheapest sequences over windows of up to
+// lz4OptNum bytes. With fullUpdate every position is searched. It returns
+// the size of the block and the number of input bytes it holds.
+func (s *lz4hcState) compressOptimal(nbSearches, sufficientLen int, fullUpdate bool) (int, int) {
+    var opt [lz4OptNum + lz4TrailingLiterals]lz4hcOptimal
+    src := s.src
+
+    ip, anchor, op := 0, 0, 0
+    iend := len(src)
+    mflimit := iend - lz4MFLimit
+    matchlimit := iend - lz4LastLiterals
+    oend := len(s.dst) - lz4LastLiterals
+    opSaved := op
+    ovml, ovref := lz4MinMatch, 0
+
+    if sufficientLen >= lz4OptNum {
+        sufficientLen = lz4OptNum - 1
+    }
+
+    for ip <= mflimit {
+        llen := ip - anchor
+        var bestMLen, bestOff, cur, lastMatchPos int
+
+        firstLen, firstOff := s.findLongerMatch(ip, matchlimit, lz4MinMatch-1, nbSearches)
+        if firstLen == 0 {
+            ip++
+            continue
+        }
+
+        if firstLen > sufficientLen {
+            // Good enough, encode it right away.
+            matchPos := ip - firstOff
+            opSaved = op
+            if s.encodeSequence(&ip, &op, &anchor, firstLen, matchPos, true, oend) {
+                ovml, ovref = firstLen, matchPos
+                goto destOverflow
+            }
+            continue
+        }
+
+        for rPos := 0; rPos < lz4MinMatch; rPos++ {
+            opt[rPos] = lz4hcOptimal{price: lz4hcLiteralsPrice(llen + rPos), mlen: 1, litlen: llen + rPos}
+        }
+        for mlen := lz4MinMatch; mlen <= firstLen; mlen++ {
+            opt[mlen] = lz4hcOptimal{price: lz4hcSequencePrice(llen, mlen), off: firstOff, mlen: mlen, litlen: llen}
+        }
+        lastMatchPos = firstLen
+        for addLit := 1; addLit <= lz4TrailingLiterals; addLit++ {
+            opt[lastMatchPos+addLit] = lz4hcOptimal{price: opt[lastMatchPos].price + lz4hcLiteralsPrice(addLit), mlen: 1, litlen: addLit}
+        }
+
+        for cur = 1; cur < lastMatchPos; cur++ {
+            curPtr := ip + cur
+            if curPtr > mflimit {
+                break
+            }
+            if fullUpdate {
+                // Skip if the next position is as cheap, unless the cost
+                // rises sharply after it.
+                if opt[cur+1].price <= opt[cur].price && opt[cur+lz4MinMatch].price < opt[cur].price+3 {
+                    continue
+                }
+            } else if opt[cur+1].price <= opt[cur].price {
+                continue
+            }
+
+            var newLen, newOff int
+            if fullUpdate {
+                newLen, newOff = s.findLongerMatch(curPtr, matchlimit, lz4MinMatch-1, nbSearches)
+            } else {
+                newLen, newOff = s.findLongerMatch(curPtr, matchlimit, lastMatchPos-cur, nbSearches)
+            }
+            if newLen == 0 {
+                continue
+            }
+
+            if newLen > sufficientLen || newLen+cur >= lz4OptNum {
+                bestMLen, bestOff = newLen, newOff
+                lastMatchPos = cur + 1
+                goto encode
+            }
+
+            // Prices of literals before the match.
+            baseLitlen := opt[cur].litlen
+            for litlen := 1; litlen < lz4MinMatch; litlen++ {
+                price := opt[cur].price - lz4hcLiteralsPrice(baseLitlen) + lz4hcLiteralsPrice(baseLitlen+litlen)
+                pos := cur + litlen
+                if price < opt[pos].price {
+                    opt[pos] = lz4hcOptimal{price: price, mlen: 1, litlen: baseLitlen + litlen}
+                }
+            }
+
+            // Prices using the match at cur.
+            for ml := lz4MinMatch; ml <= newLen; ml++ {
+                pos := cur + ml
+                var price, ll int
+                if opt[cur].mlen == 1 {
+                    ll = opt[cur].litlen
+                    if cur > ll {
+                        price = opt[cur-ll].price
+                    }
+                    price += lz4hcSequencePrice(ll, ml)
+                } else {
+                    price = opt[cur].price + lz4hcSequencePrice(0, ml)
+                }
+                if pos > lastMatchPos+lz4TrailingLiterals || price <= opt[pos].price {
+                    if ml == newLen && lastMatchPos < pos {
+                        lastMatchPos = pos
+                    }
+                    opt[pos] = lz4hcOptimal{price: price, off: newOff, mlen: ml, litlen: ll}
+                }
+            }
+
+            for addLit := 1; addLit <= lz4TrailingLiterals; addLit++ {
+                opt[lastMatchPos+addLit] = lz4hcOptimal{price: opt[lastMatchPos].price + lz4hcLiteralsPrice(addLit), mlen: 1, litlen: addLit}
+            }
+        }
+
+        bestMLen = opt[lastMatchPos].mlen
+        bestOff = opt[lastMatchPos].off
+        cur = lastMatchPos - bestMLen
+
+    encode:
+        {
+            // Walk back from the end to find the path of the cheapest
+            // sequences.
+            candidatePos := cur
+            selectedMatchLength := bestMLen
+            selectedOffset := bestOff
+            for {
+                nextMatchLength := opt[candidatePos].mlen
+                nextOffset := opt[candidatePos].off
+                opt[candidatePos].mlen = selectedMatchLength
+                opt[candidatePos].off = selectedOffset
+                selectedMatchLength = nextMatchLength
+                selectedOffset = nextOffset
+                if nextMatchLength > candidatePos {
+                    break
+                }
+                candidatePos -= nextMatchLength
+            }
+        }
+
+        for rPos := 0; rPos < lastMatchPos; {
+            ml := opt[rPos].mlen
+            offset := opt[rPos].off
+            if ml == 1 {
+                ip++
+                rPos++
+                continue
+            }
+            rPos += ml
+            opSaved = op
+            if s.encodeSequence(&ip, &op, &anchor, ml, ip-offset, true, oend) {
+                ovml, ovref = ml, ip-offset
+                goto destOverflow
+            }
+        }
+    }
+
+lastLiterals:
+    ip = s.lastLiterals(anchor, &op, oend+lz4LastLiterals)
+    return op, ip
+
+destOverflow:
+    op = opSaved
+    s.overflow(&ip, &op, &anchor, ovml, ovref, oend)
+    goto lastLiterals
+}
+
+// lz4hcCompressDestSize compresses as much of src as fits in target bytes at
+// the given level, like LZ4_compress_HC_destSize. It returns the block and
+// the number of bytes of src it holds.
+func lz4hcCompressDestSize(src []byte, target int, level int) ([]byte, int) {
+    if target < 1 {
+        return nil, 0
+    }
+    if level < 1 {
+        level = lz4hcClevelDefault
+    }
+    if level > lz4hcClevelMax {
+        level = lz4hcClevelMax
+    }
+
+    s := &lz4hcState{src: src, dst: make([]byte, target), nextToUpdate: lz4hcBase}
+    params := lz4hcLevels[level]
+    var size, consumed int
+    if params.optimal {
+        size, consumed = s.compressOptimal(params.nbSearches, params.targetLength, level == lz4hcClevelMax)
+    } else {
+        size, consumed = s.compressHashChain(params.nbSearches)
+    }
+    return s.dst[:size], consumed
+}
@@ -0,0 +1,66 @@
+package payload
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "io"
+
+    "google.golang.org/protobuf/encoding/protojson"
+    "google.golang.org/protobuf/encoding/prototext"
+    "google.golang.org/protobuf/proto"
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// Formats accepted by DumpManifest.
+const (
+    ManifestFormatJSON = "json"
+    ManifestFormatText = "text"
+)
+
+// DumpManifest writes the full manifest, down to every operation and extent,
+// to w as protojson or textproto. If partitions is not empty, only those
+// partitions are included.
+func (p *Payload) DumpManifest(w io.Writer, format string, partitions []string) error {
+    if !p.initialized {
+        return errors.New("Payload has not been initialized")
+    }
+
+    manifest := p.deltaArchiveManifest
+    if len(partitions) > 0 {
+        manifest = proto.Clone(manifest).(*chromeos_update_engine.DeltaArchiveManifest)
+        manifest.Partitions = nil
+        for _, name := range partitions {
+            found := false
+            for _, partition := range p.deltaArchiveManifest.Partitions {
+                if partition.GetPartitionName() == name {
+                    manifest.Partitions = append(manifest.Partitions, partition)
+                    found = true
+                    break
+                }
+            }
+            if !found {
+                return fmt.Errorf("Partition not found in payload: %s", name)
+            }
+        }
+    }
+
+    var data []byte
+    var err error
+    switch format {
+    case ManifestFormatJSON:
+        data, err = protojson.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(manifest)
+    case ManifestFormatText:
+        data, err = prototext.MarshalOptions{Multiline: true, Indent: "  "}.Marshal(manifest)
+    default:
+        return fmt.Errorf("Unknown manifest format: %s", format)
+    }
+    if err != nil {
+        return err
+    }
+    if !bytes.HasSuffix(data, []byte("\n")) {
+        data = append(data, '\n')
+    }
+    _, err = w.Write(data)
+    return err
+}
@@ -3,6 +3,7 @@ package payload
 import (
     "bytes"
     "compress/bzip2"
+    "context"
     "crypto/sha256"
     "encoding/binary"
     "encoding/hex"
@@ -10,13 +11,14 @@ import (
     "fmt"
     "io"
     "os"
+    "path/filepath"
+    "strings"
     "sync"
+    "time"
 
     "github.com/dustin/go-humanize"
     "github.com/spencercw/go-xz"
     "github.com/valyala/gozstd"
-    "github.com/vbauerster/mpb/v5"
-    "github.com/vbauerster/mpb/v5/decor"
     "google.golang.org/protobuf/proto"
     "github.com/ssut/payload-dumper-go/chromeos_update_engine"
 )
@@ -28,19 +30,32 @@ const (
     blockSize = 4096
 )
 
+// ErrZucchiniUnsupported is returned for Zucchini patches of executables.
+// Applying them requires Zucchini's executable disassemblers, which are not
+// implemented; patches of raw data are applied.
+var ErrZucchiniUnsupported = errors.New("Zucchini patches of executables are not supported")
+
 type Payload struct {
     Filename    string
     file       *os.File
+    reader     *io.SectionReader
+    stream     io.Reader
+    tempFilename string
     header     *payloadHeader
     deltaArchiveManifest *chromeos_update_engine.DeltaArchiveManifest
     signatures *chromeos_update_engine.Signatures
     concurrency int
+    sourceDirectory string
+    sparseOutput bool
+    logger     Logger
+    progress   ProgressReporter
     metadataSize int64
     dataOffset   int64
     initialized  bool
     requests    chan *request
     workerWG    sync.WaitGroup
-    progress    *mpb.Progress
+    resultsMu   sync.Mutex
+    results     map[string]*ExtractResult
 }
 
 type payloadHeader struct {
@@ -56,10 +71,22 @@ type request struct {
     targetDirectory string
 }
 
-type ProgressReporter struct {
-    bar     *mpb.Bar
-    total   int64
-    current int64
+// Logger receives informational messages, such as the header fields and the
+// partitions found by Init. *log.Logger satisfies it.
+type Logger interface {
+    Printf(format string, v ...interface{})
+}
+
+// ProgressReporter is notified while partitions are extracted. Partitions
+// are extracted concurrently, so the methods must be safe for concurrent use.
+type ProgressReporter interface {
+    // Start is called before the operations of partition are applied.
+    Start(partition *chromeos_update_engine.PartitionUpdate)
+    // Increment is called after each applied operation of partition.
+    Increment(partition *chromeos_update_engine.PartitionUpdate)
+    // Done is called once for every partition, when it has been extracted or
+    // has failed.
+    Done(partition *chromeos_update_engine.PartitionUpdate, result ExtractResult)
 }
 
 func NewPayload(filename string) *Payload {
@@ -69,6 +96,16 @@ func NewPayload(filename string) *Payload {
     }
 }
 
+// NewPayloadFromReader returns a payload that reads size bytes from r, such
+// as a zip entry, a memory buffer or a remote file. Open is a no-op for it and
+// Close leaves r open.
+func NewPayloadFromReader(r io.ReaderAt, size int64) *Payload {
+    return &Payload{
+        reader:      io.NewSectionReader(r, 0, size),
+        concurrency: 4,
+    }
+}
+
 func (p *Payload) SetConcurrency(n int) {
     p.concurrency = n
 }
@@ -77,25 +114,117 @@ func (p *Payload) GetConcurrency() int {
     return p.concurrency
 }
 
+// SetSourceDirectory sets the directory holding the old partition images
+// (<partition>.img) that incremental operations are applied against.
+func (p *Payload) SetSourceDirectory(dir string) {
+    p.sourceDirectory = dir
+}
+
+func (p *Payload) GetSourceDirectory() string {
+    return p.sourceDirectory
+}
+
+// SetSparseOutput makes extraction write Android sparse images
+// (<partition>.simg) instead of raw images.
+func (p *Payload) SetSparseOutput(sparse bool) {
+    p.sparseOutput = sparse
+}
+
+func (p *Payload) GetSparseOutput() bool {
+    return p.sparseOutput
+}
+
+// SetLogger sets the logger for informational messages. Nothing is logged by
+// default.
+func (p *Payload) SetLogger(logger Logger) {
+    p.logger = logger
+}
+
+func (p *Payload) GetLogger() Logger {
+    return p.logger
+}
+
+// SetProgressReporter sets the reporter notified during extraction. No
+// progress is reported by default.
+func (p *Payload) SetProgressReporter(progress ProgressReporter) {
+    p.progress = progress
+}
+
+func (p *Payload) GetProgressReporter() ProgressReporter {
+    return p.progress
+}
+
+func (p *Payload) logf(format string, v ...interface{}) {
+    if p.logger != nil {
+        p.logger.Printf(format, v...)
+    }
+}
+
+// Open opens the payload file, or the http(s) URL it names. OTA zips are
+// opened too, in which case the payload.bin entry inside them is read.
 func (p *Payload) Open() error {
-    file, err := os.Open(p.Filename)
-    if err != nil {
-        return err
+    return p.OpenContext(context.Background())
+}
+
+// OpenContext is like Open. A payload read over http(s) issues its requests
+// with ctx, so once ctx is done, reads stop even if the server stalls.
+func (p *Payload) OpenContext(ctx context.Context) error {
+    if p.reader != nil {
+        return nil
     }
-    p.file = file
+    if p.stream != nil {
+        return p.openStream()
+    }
+
+    var r io.ReaderAt
+    var size int64
+    if isURL(p.Filename) {
+        httpReader, err := NewHTTPReaderContext(ctx, p.Filename)
+        if err != nil {
+            return err
+        }
+        r, size = httpReader, httpReader.Size()
+    } else {
+        file, err := os.Open(p.Filename)
+        if err != nil {
+            return err
+        }
+        p.file = file
+
+        stat, err := file.Stat()
+        if err != nil {
+            return err
+        }
+        r, size = file, stat.Size()
+    }
+
+    if isZipName(p.Filename) {
+        reader, err := p.openZipEntry(r, size)
+        if err != nil {
+            return err
+        }
+        p.reader = reader
+        return nil
+    }
+    p.reader = io.NewSectionReader(r, 0, size)
     return nil
 }
 
 func (p *Payload) Close() error {
+    var err error
     if p.file != nil {
-        return p.file.Close()
+        err = p.file.Close()
     }
-    return nil
+    if p.tempFilename != "" {
+        os.Remove(p.tempFilename)
+        p.tempFilename = ""
+    }
+    return err
 }
 
 func (ph *payloadHeader) ReadFromPayload() error {
     buf := make([]byte, 4)
-    if _, err := ph.payload.file.Read(buf); err != nil {
+    if _, err := io.ReadFull(ph.payload.reader, buf); err != nil {
         return err
     }
     if string(buf) != payloadHeaderMagic {
@@ -103,36 +232,36 @@ func (ph *payloadHeader) ReadFromPayload() error {
     }
 
     buf = make([]byte, 8)
-    if _, err := ph.payload.file.Read(buf); err != nil {
+    if _, err := io.ReadFull(ph.payload.reader, buf); err != nil {
         return err
     }
     ph.Version = binary.BigEndian.Uint64(buf)
-    fmt.Printf("Payload Version: %d\n", ph.Version)
+    ph.payload.logf("Payload Version: %d", ph.Version)
 
     if ph.Version != brilloMajorPayloadVersion {
         return fmt.Errorf("Unsupported payload version: %d", ph.Version)
     }
 
     buf = make([]byte, 8)
-    if _, err := ph.payload.file.Read(buf); err != nil {
+    if _, err := io.ReadFull(ph.payload.reader, buf); err != nil {
         return err
     }
     ph.ManifestLen = binary.BigEndian.Uint64(buf)
-    fmt.Printf("Payload Manifest Length: %d\n", ph.ManifestLen)
+    ph.payload.logf("Payload Manifest Length: %d", ph.ManifestLen)
     ph.Size = 24
 
     buf = make([]byte, 4)
-    if _, err := ph.payload.file.Read(buf); err != nil {
+    if _, err := io.ReadFull(ph.payload.reader, buf); err != nil {
         return err
     }
     ph.MetadataSignatureLen = binary.BigEndian.Uint32(buf)
-    fmt.Printf("Payload Manifest Signature Length: %d\n", ph.MetadataSignatureLen)
+    ph.payload.logf("Payload Manifest Signature Length: %d", ph.MetadataSignatureLen)
     return nil
 }
 
 func (p *Payload) readManifest() (*chromeos_update_engine.DeltaArchiveManifest, error) {
     buf := make([]byte, p.header.ManifestLen)
-    if _, err := p.file.Read(buf); err != nil {
+    if _, err := io.ReadFull(p.reader, buf); err != nil {
         return nil, err
     }
     deltaArchiveManifest := &chromeos_update_engine.DeltaArchiveManifest{}
@@ -143,11 +272,11 @@ func (p *Payload) readManifest() (*chromeos_update_engine.DeltaArchiveManifest,
 }
 
 func (p *Payload) readMetadataSignature() (*chromeos_update_engine.Signatures, error) {
-    if _, err := p.file.Seek(int64(p.header.Size+p.header.ManifestLen), 0); err != nil {
+    if _, err := p.reader.Seek(int64(p.header.Size+p.header.ManifestLen), 0); err != nil {
         return nil, err
     }
     buf := make([]byte, p.header.MetadataSignatureLen)
-    if _, err := p.file.Read(buf); err != nil {
+    if _, err := io.ReadFull(p.reader, buf); err != nil {
         return nil, err
     }
     signatures := &chromeos_update_engine.Signatures{}
@@ -158,6 +287,9 @@ func (p *Payload) readMetadataSignature() (*chromeos_update_engine.Signatures, e
 }
 
 func (p *Payload) Init() error {
+    if p.reader == nil {
+        return errors.New("Payload has not been opened")
+    }
     p.header = &payloadHeader{
         payload: p,
     }
@@ -180,15 +312,11 @@ func (p *Payload) Init() error {
     p.metadataSize = int64(p.header.Size + p.header.ManifestLen)
     p.dataOffset = p.metadataSize + int64(p.header.MetadataSignatureLen)
 
-    fmt.Println("Found partitions:")
-    for i, partition := range p.deltaArchiveManifest.Partitions {
-        fmt.Printf("%s (%s)", partition.GetPartitionName(), humanize.Bytes(*partition.GetNewPartitionInfo().Size))
-        if i < len(deltaArchiveManifest.Partitions)-1 {
-            fmt.Printf(", ")
-        } else {
-            fmt.Printf("\n")
-        }
+    var found []string
+    for _, partition := range p.deltaArchiveManifest.Partitions {
+        found = append(found, fmt.Sprintf("%s (%s)", partition.GetPartitionName(), humanize.Bytes(partition.GetNewPartitionInfo().GetSize())))
     }
+    p.logf("Found partitions:\n%s", strings.Join(found, ", "))
 
     p.initialized = true
     return nil
@@ -196,7 +324,7 @@ func (p *Payload) Init() error {
 
 func (p *Payload) readDataBlob(offset int64, length int64) ([]byte, error) {
     buf := make([]byte, length)
-    n, err := p.file.ReadAt(buf, p.dataOffset+offset)
+    n, err := p.reader.ReadAt(buf, p.dataOffset+offset)
     if err != nil {
         return nil, err
     }
@@ -206,162 +334,448 @@ func (p *Payload) readDataBlob(offset int64, length int64) ([]byte, error) {
     return buf, nil
 }
 
-func (p *Payload) Extract(partition *chromeos_update_engine.PartitionUpdate, out *os.File) error {
-    name := partition.GetPartitionName()
-    info := partition.GetNewPartitionInfo()
-    totalOperations := len(partition.Operations)
-    barName := fmt.Sprintf("%s (%s)", name, humanize.Bytes(info.GetSize()))
-    
-    bar := p.progress.AddBar(
-        int64(totalOperations),
-        mpb.PrependDecorators(
-            decor.Name(barName, decor.WCSyncSpaceR),
-        ),
-        mpb.AppendDecorators(
-            decor.Percentage(),
-        ),
-    )
-    defer bar.SetTotal(0, true)
-
-    for _, operation := range partition.Operations {
-        if len(operation.DstExtents) == 0 {
-            return fmt.Errorf("Invalid operation.DstExtents for the partition %s", name)
-        }
-        bar.Increment()
-
-        e := operation.DstExtents[0]
-        dataOffset := p.dataOffset + int64(operation.GetDataOffset())
-        dataLength := int64(operation.GetDataLength())
+func (p *Payload) openSource(name string) (*os.File, error) {
+    if p.sourceDirectory == "" {
+        return nil, fmt.Errorf("Source image directory is required for the incremental partition %s", name)
+    }
+    return os.Open(filepath.Join(p.sourceDirectory, fmt.Sprintf("%s.img", name)))
+}
 
-        _, err := out.Seek(int64(e.GetStartBlock())*blockSize, 0)
+// sameDirectory reports whether a and b name the same directory. Extracting
+// into the source directory would truncate the old images before they are
+// read.
+func sameDirectory(a, b string) bool {
+    aInfo, aErr := os.Stat(a)
+    bInfo, bErr := os.Stat(b)
+    if aErr == nil && bErr == nil {
+        return os.SameFile(aInfo, bInfo)
+    }
+    aAbs, aErr := filepath.Abs(a)
+    bAbs, bErr := filepath.Abs(b)
+    return aErr == nil && bErr == nil && aAbs == bAbs
+}
+
+func (p *Payload) progressStart(partition *chromeos_update_engine.PartitionUpdate) {
+    if p.progress != nil {
+        p.progress.Start(partition)
+    }
+}
+
+func (p *Payload) progressIncrement(partition *chromeos_update_engine.PartitionUpdate) {
+    if p.progress != nil {
+        p.progress.Increment(partition)
+    }
+}
+
+// partitionWriter applies the operations of a partition to its image. Once
+// ctx is done, operations and verity data fail with ctx.Err().
+type partitionWriter struct {
+    ctx       context.Context
+    payload   *Payload
+    partition *chromeos_update_engine.PartitionUpdate
+    out       *os.File
+    source    *os.File
+    // fresh is set if out was created empty by createImage, so that zeroed
+    // regions can be left as holes.
+    fresh     bool
+}
+
+func newPartitionWriter(ctx context.Context, p *Payload, partition *chromeos_update_engine.PartitionUpdate, out *os.File, fresh bool) *partitionWriter {
+    return &partitionWriter{
+        ctx:       ctx,
+        payload:   p,
+        partition: partition,
+        out:       out,
+        fresh:     fresh,
+    }
+}
+
+func (w *partitionWriter) close() {
+    if w.source != nil {
+        w.source.Close()
+        w.source = nil
+    }
+}
+
+func (w *partitionWriter) readSource(index int, operation *chromeos_update_engine.InstallOperation) ([]byte, error) {
+    if w.source == nil {
+        file, err := w.payload.openSource(w.partition.GetPartitionName())
         if err != nil {
-            return err
+            return nil, err
         }
+        w.source = file
+        if err := verifySourceImage(&contextFile{w.ctx, w.source}, w.partition); err != nil {
+            return nil, err
+        }
+    }
+    data, err := readExtents(&contextFile{w.ctx, w.source}, operation.SrcExtents)
+    if err != nil {
+        return nil, err
+    }
+    if err := verifySourceData(data, w.partition, index, operation); err != nil {
+        return nil, err
+    }
+    return data, nil
+}
 
-        expectedUncompressedBlockSize := int64(e.GetNumBlocks() * blockSize)
-        bufSha := sha256.New()
-        teeReader := io.TeeReader(io.NewSectionReader(p.file, dataOffset, dataLength), bufSha)
-
-        switch operation.GetType() {
-        case chromeos_update_engine.InstallOperation_REPLACE:
-            n, err := io.Copy(out, teeReader)
-            if err != nil {
-                return err
-            }
-            if int64(n) != expectedUncompressedBlockSize {
-                return fmt.Errorf("Verify failed (Unexpected bytes written): %s (%d != %d)", name, n, expectedUncompressedBlockSize)
-            }
-            break
+// apply applies the operation with the given index, reading its data from
+// blob.
+func (w *partitionWriter) apply(i int, operation *chromeos_update_engine.InstallOperation, blob io.Reader) error {
+    name := w.partition.GetPartitionName()
+    out := w.out
+    if err := w.ctx.Err(); err != nil {
+        return err
+    }
+    if len(operation.DstExtents) == 0 {
+        return fmt.Errorf("Invalid operation.DstExtents for the partition %s", name)
+    }
+    blob = &contextReader{w.ctx, blob}
 
-        case chromeos_update_engine.InstallOperation_REPLACE_XZ:
-            reader := xz.NewDecompressionReader(teeReader)
-            n, err := io.Copy(out, &reader)
-            if err != nil {
-                return err
-            }
-            reader.Close()
-            if n != expectedUncompressedBlockSize {
-                return fmt.Errorf("Verify failed (Unexpected bytes written): %s (%d != %d)", name, n, expectedUncompressedBlockSize)
-            }
-            break
+    writer := newExtentWriter(out, operation.DstExtents)
+    expectedUncompressedBlockSize := extentsSize(operation.DstExtents)
+    bufSha := sha256.New()
+    teeReader := io.TeeReader(blob, bufSha)
 
-        case chromeos_update_engine.InstallOperation_REPLACE_BZ:
-            reader := bzip2.NewReader(teeReader)
-            n, err := io.Copy(out, reader)
-            if err != nil {
-                return err
-            }
-            if n != expectedUncompressedBlockSize {
-                return fmt.Errorf("Verify failed (Unexpected bytes written): %s (%d != %d)", name, n, expectedUncompressedBlockSize)
-            }
-            break
+    switch operation.GetType() {
+    case chromeos_update_engine.InstallOperation_REPLACE:
+        n, err := io.Copy(writer, teeReader)
+        if err != nil {
+            return err
+        }
+        if int64(n) != expectedUncompressedBlockSize {
+            return fmt.Errorf("Verify failed (Unexpected bytes written): %s (%d != %d)", name, n, expectedUncompressedBlockSize)
+        }
+        break
 
-        case chromeos_update_engine.InstallOperation_ZERO:
-            reader := bytes.NewReader(make([]byte, expectedUncompressedBlockSize))
-            n, err := io.Copy(out, reader)
-            if err != nil {
-                return err
-            }
-            if n != expectedUncompressedBlockSize {
-                return fmt.Errorf("Verify failed (Unexpected bytes written): %s (%d != %d)", name, n, expectedUncompressedBlockSize)
-            }
-            break
+    case chromeos_update_engine.InstallOperation_REPLACE_XZ:
+        reader := xz.NewDecompressionReader(teeReader)
+        n, err := io.Copy(writer, &reader)
+        if err != nil {
+            return err
+        }
+        reader.Close()
+        if n != expectedUncompressedBlockSize {
+            return fmt.Errorf("Verify failed (Unexpected bytes written): %s (%d != %d)", name, n, expectedUncompressedBlockSize)
+        }
+        break
 
-        case chromeos_update_engine.InstallOperation_ZSTD:
-            reader := gozstd.NewReader(teeReader)
-            n, err := io.Copy(out, reader)
-            if err != nil {
+    case chromeos_update_engine.InstallOperation_REPLACE_BZ:
+        reader := bzip2.NewReader(teeReader)
+        n, err := io.Copy(writer, reader)
+        if err != nil {
+            return err
+        }
+        if n != expectedUncompressedBlockSize {
+            return fmt.Errorf("Verify failed (Unexpected bytes written): %s (%d != %d)", name, n, expectedUncompressedBlockSize)
+        }
+        break
+
+    case chromeos_update_engine.InstallOperation_ZERO,
+        chromeos_update_engine.InstallOperation_DISCARD:
+        // Images created by createImage are empty, so these regions are left
+        // as holes that read back as zeros. finish extends the image to its
+        // full size. Other files may hold old data that has to be cleared.
+        if !w.fresh {
+            if err := writeZeros(out, operation.DstExtents); err != nil {
                 return err
             }
-            if n != expectedUncompressedBlockSize {
-                return fmt.Errorf("Verify failed (Unexpected bytes written): %s (%d != %d)", name, n, expectedUncompressedBlockSize)
-            }
-            break
+        }
+        break
 
-        default:
-            return fmt.Errorf("Unhandled operation type: %s", operation.GetType().String())
+    case chromeos_update_engine.InstallOperation_ZSTD:
+        reader := gozstd.NewReader(teeReader)
+        n, err := io.Copy(writer, reader)
+        if err != nil {
+            return err
         }
+        if n != expectedUncompressedBlockSize {
+            return fmt.Errorf("Verify failed (Unexpected bytes written): %s (%d != %d)", name, n, expectedUncompressedBlockSize)
+        }
+        break
 
-        hash := hex.EncodeToString(bufSha.Sum(nil))
-        expectedHash := hex.EncodeToString(operation.GetDataSha256Hash())
-        if expectedHash != "" && hash != expectedHash {
-            return fmt.Errorf("Verify failed (Checksum mismatch): %s (%s != %s)", name, hash, expectedHash)
+    case chromeos_update_engine.InstallOperation_SOURCE_COPY:
+        data, err := w.readSource(i, operation)
+        if err != nil {
+            return err
         }
+        if err := writeExtents(out, operation.DstExtents, data); err != nil {
+            return err
+        }
+        break
+
+    case chromeos_update_engine.InstallOperation_SOURCE_BSDIFF,
+        chromeos_update_engine.InstallOperation_BROTLI_BSDIFF,
+        chromeos_update_engine.InstallOperation_PUFFDIFF,
+        chromeos_update_engine.InstallOperation_ZUCCHINI,
+        chromeos_update_engine.InstallOperation_LZ4DIFF_BSDIFF,
+        chromeos_update_engine.InstallOperation_LZ4DIFF_PUFFDIFF:
+        patch, err := io.ReadAll(teeReader)
+        if err != nil {
+            return err
+        }
+        // The patch is checked before it is applied, the patchers trust the
+        // sizes recorded in it.
+        if err := verifyDataHash(name, operation, bufSha.Sum(nil)); err != nil {
+            return err
+        }
+        old, err := w.readSource(i, operation)
+        if err != nil {
+            return err
+        }
+        apply := bspatch
+        switch operation.GetType() {
+        case chromeos_update_engine.InstallOperation_PUFFDIFF:
+            apply = puffpatch
+        case chromeos_update_engine.InstallOperation_ZUCCHINI:
+            apply = zucchinipatch
+        case chromeos_update_engine.InstallOperation_LZ4DIFF_BSDIFF,
+            chromeos_update_engine.InstallOperation_LZ4DIFF_PUFFDIFF:
+            apply = lz4diffpatch
+        }
+        data, err := apply(w.ctx, old, patch, expectedUncompressedBlockSize)
+        if err != nil {
+            return fmt.Errorf("%w: %s", err, name)
+        }
+        if n := int64(len(data)); n != expectedUncompressedBlockSize {
+            return fmt.Errorf("Verify failed (Unexpected bytes written): %s (%d != %d)", name, n, expectedUncompressedBlockSize)
+        }
+        if err := writeExtents(out, operation.DstExtents, data); err != nil {
+            return err
+        }
+        break
+
+    default:
+        return fmt.Errorf("Unhandled operation type: %s", operation.GetType().String())
+    }
+
+    return verifyDataHash(name, operation, bufSha.Sum(nil))
+}
+
+// verifyDataHash checks the hash of the data blob of operation, if the
+// manifest has one.
+func verifyDataHash(name string, operation *chromeos_update_engine.InstallOperation, hash []byte) error {
+    expected := operation.GetDataSha256Hash()
+    if len(expected) != 0 && !bytes.Equal(hash, expected) {
+        return fmt.Errorf("Verify failed (Checksum mismatch): %s (%s != %s)", name, hex.EncodeToString(hash), hex.EncodeToString(expected))
     }
     return nil
 }
 
-func (p *Payload) worker() {
-    for req := range p.requests {
-        partition := req.partition
-        targetDirectory := req.targetDirectory
-        name := fmt.Sprintf("%s.img", partition.GetPartitionName())
-        filepath := fmt.Sprintf("%s/%s", targetDirectory, name)
-        
-        file, err := os.OpenFile(filepath, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0o755)
+// finish writes the verity data of the partition and checks the hash of the
+// resulting image.
+func (w *partitionWriter) finish() (HashStatus, error) {
+    name := w.partition.GetPartitionName()
+    info := w.partition.GetNewPartitionInfo()
+    if size := int64(info.GetSize()); size > 0 {
+        stat, err := w.out.Stat()
         if err != nil {
-            fmt.Println(err.Error())
-            continue
+            return HashUnavailable, err
         }
+        if stat.Size() < size {
+            if err := w.out.Truncate(size); err != nil {
+                return HashUnavailable, err
+            }
+        }
+    }
+    out := &contextFile{w.ctx, w.out}
+    if err := writeHashTree(out, w.partition); err != nil {
+        return HashUnavailable, fmt.Errorf("Failed to write hash tree: %s (%w)", name, err)
+    }
+    if err := writeFEC(out, w.partition); err != nil {
+        return HashUnavailable, fmt.Errorf("Failed to write FEC data: %s (%w)", name, err)
+    }
 
-        if err := p.Extract(partition, file); err != nil {
-            fmt.Println(err.Error())
+    status, hash, err := verifyPartitionHash(out, info)
+    if err != nil {
+        return HashUnavailable, err
+    }
+    if status == HashMismatched {
+        return status, fmt.Errorf("Verify failed (Partition hash mismatch): %s (%s != %s)", name, hex.EncodeToString(hash), hex.EncodeToString(info.GetHash()))
+    }
+    return status, nil
+}
+
+// Extract writes the image of partition to out. out does not have to be
+// empty, regions that the payload zeroes are written out. If the manifest
+// has a hash, a hash tree or FEC data for the partition, the image is read
+// back from out, which then has to be open for reading and writing.
+func (p *Payload) Extract(partition *chromeos_update_engine.PartitionUpdate, out *os.File) error {
+    return p.ExtractContext(context.Background(), partition, out)
+}
+
+// ExtractContext is like Extract, but stops with ctx.Err() once ctx is done.
+func (p *Payload) ExtractContext(ctx context.Context, partition *chromeos_update_engine.PartitionUpdate, out *os.File) error {
+    start := time.Now()
+    if readsImageBack(partition) {
+        if _, err := out.ReadAt(make([]byte, 1), 0); err != nil && err != io.EOF {
+            err = fmt.Errorf("Output file must be open for reading and writing: %s (%w)", out.Name(), err)
+            p.recordResult(partition, start, HashUnavailable, err)
+            return err
         }
-        
-        file.Close()
+    }
+    status, err := p.extract(ctx, partition, out, false)
+    p.recordResult(partition, start, status, err)
+    return err
+}
+
+func (p *Payload) extract(ctx context.Context, partition *chromeos_update_engine.PartitionUpdate, out *os.File, fresh bool) (HashStatus, error) {
+    p.progressStart(partition)
+
+    w := newPartitionWriter(ctx, p, partition, out, fresh)
+    defer w.close()
+
+    for i, operation := range partition.Operations {
+        dataOffset := p.dataOffset + int64(operation.GetDataOffset())
+        dataLength := int64(operation.GetDataLength())
+        if err := w.apply(i, operation, io.NewSectionReader(p.reader, dataOffset, dataLength)); err != nil {
+            return HashUnavailable, err
+        }
+        p.progressIncrement(partition)
+    }
+
+    return w.finish()
+}
+
+// readsImageBack reports whether extracting partition reads the image back,
+// to check its hash or to build verity data from it.
+func readsImageBack(partition *chromeos_update_engine.PartitionUpdate) bool {
+    return len(partition.GetNewPartitionInfo().GetHash()) > 0 ||
+        partition.GetHashTreeExtent().GetNumBlocks() > 0 ||
+        partition.GetFecExtent().GetNumBlocks() > 0
+}
+
+// createImage creates the file the image of partition is extracted to. For
+// sparse output that is a temporary raw image, see closeImage.
+func (p *Payload) createImage(targetDirectory string, partition *chromeos_update_engine.PartitionUpdate) (*os.File, error) {
+    name := partition.GetPartitionName()
+    if p.sparseOutput {
+        return os.CreateTemp(targetDirectory, fmt.Sprintf("%s.*.img.tmp", name))
+    }
+    return os.OpenFile(filepath.Join(targetDirectory, fmt.Sprintf("%s.img", name)), os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0o755)
+}
+
+// closeImage closes an image created by createImage. For sparse output the
+// raw image is converted to <partition>.simg if extracted is set, and removed.
+func (p *Payload) closeImage(targetDirectory string, partition *chromeos_update_engine.PartitionUpdate, file *os.File, extracted bool) error {
+    if !p.sparseOutput {
+        return file.Close()
+    }
+    defer os.Remove(file.Name())
+    defer file.Close()
+    if !extracted {
+        return nil
+    }
+
+    name := fmt.Sprintf("%s.simg", partition.GetPartitionName())
+    out, err := os.OpenFile(filepath.Join(targetDirectory, name), os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0o755)
+    if err != nil {
+        return err
+    }
+    if err := writeSparseImage(out, file, partition); err != nil {
+        out.Close()
+        return err
+    }
+    return out.Close()
+}
+
+// discardImage removes the partial image in file, already closed by
+// closeImage, after the extraction has been cancelled. Sparse output leaves
+// nothing behind to remove.
+func (p *Payload) discardImage(file *os.File) {
+    if !p.sparseOutput {
+        os.Remove(file.Name())
+    }
+}
+
+func (p *Payload) worker(ctx context.Context) {
+    for req := range p.requests {
+        p.extractRequest(ctx, req)
         p.workerWG.Done()
     }
 }
 
-func (p *Payload) spawnExtractWorkers(n int) {
+func (p *Payload) extractRequest(ctx context.Context, req *request) {
+    partition := req.partition
+    targetDirectory := req.targetDirectory
+    start := time.Now()
+
+    if err := ctx.Err(); err != nil {
+        p.recordResult(partition, start, HashUnavailable, err)
+        return
+    }
+    file, err := p.createImage(targetDirectory, partition)
+    if err != nil {
+        p.recordResult(partition, start, HashUnavailable, err)
+        return
+    }
+
+    status, err := p.extract(ctx, partition, file, true)
+    if closeErr := p.closeImage(targetDirectory, partition, file, err == nil); err == nil {
+        err = closeErr
+    }
+    if err != nil && ctx.Err() != nil {
+        p.discardImage(file)
+    }
+    p.recordResult(partition, start, status, err)
+}
+
+func (p *Payload) spawnExtractWorkers(ctx context.Context, n int) {
     for i := 0; i < n; i++ {
-        go p.worker()
+        go p.worker(ctx)
     }
 }
 
+// ExtractSelected extracts the given partitions, or all of them if partitions
+// is empty, to targetDirectory. If any partition fails, the returned error is
+// an *ExtractError; Results has the outcome of every partition.
 func (p *Payload) ExtractSelected(targetDirectory string, partitions []string) error {
+    return p.ExtractSelectedContext(context.Background(), targetDirectory, partitions)
+}
+
+// ExtractSelectedContext is like ExtractSelected, but stops extracting once
+// ctx is done. Partial images are removed and ctx.Err() is returned.
+func (p *Payload) ExtractSelectedContext(ctx context.Context, targetDirectory string, partitions []string) error {
     if !p.initialized {
         return errors.New("Payload has not been initialized")
     }
 
-    p.progress = mpb.New()
-    p.requests = make(chan *request, 100)
-    p.spawnExtractWorkers(p.concurrency)
-
+    var selected []*chromeos_update_engine.PartitionUpdate
     for _, partition := range p.deltaArchiveManifest.Partitions {
-        if len(partitions) > 0 {
-            found := false
-            for _, name := range partitions {
-                if name == partition.GetPartitionName() {
-                    found = true
-                    break
-                }
-            }
-            if !found {
-                continue
+        if len(partitions) == 0 || containsString(partitions, partition.GetPartitionName()) {
+            selected = append(selected, partition)
+        }
+    }
+    for _, name := range partitions {
+        found := false
+        for _, partition := range selected {
+            if partition.GetPartitionName() == name {
+                found = true
+                break
             }
         }
+        if !found {
+            return fmt.Errorf("Partition not found in payload: %s", name)
+        }
+    }
+    if p.sourceDirectory != "" && sameDirectory(p.sourceDirectory, targetDirectory) {
+        return fmt.Errorf("Source directory must differ from the output directory: %s", targetDirectory)
+    }
+
+    if p.stream != nil {
+        err := p.extractStream(ctx, targetDirectory, selected)
+        if ctx.Err() != nil {
+            return ctx.Err()
+        }
+        if extractErr := p.extractError(selected); extractErr != nil {
+            return extractErr
+        }
+        return err
+    }
+
+    p.requests = make(chan *request, 100)
+    p.spawnExtractWorkers(ctx, p.concurrency)
 
+    for _, partition := range selected {
         p.workerWG.Add(1)
         p.requests <- &request{
             partition:       partition,
@@ -371,62 +785,109 @@ func (p *Payload) ExtractSelected(targetDirectory string, partitions []string) e
 
     p.workerWG.Wait()
     close(p.requests)
-    return nil
+    if ctx.Err() != nil {
+        return ctx.Err()
+    }
+    return p.extractError(selected)
+}
+
+func containsString(list []string, s string) bool {
+    for _, v := range list {
+        if v == s {
+            return true
+        }
+    }
+    return false
 }
 
 func (p *Payload) ExtractAll(targetDirectory string) error {
     return p.ExtractSelected(targetDirectory, nil)
 }
 
-func PrintVersionInfo() {
-    fmt.Printf("Payload Dumper Go v%s\n", Version)
-    fmt.Printf("Block Size: %d bytes\n", blockSize)
+func (p *Payload) ExtractAllContext(ctx context.Context, targetDirectory string) error {
+    return p.ExtractSelectedContext(ctx, targetDirectory, nil)
 }
 
-func (p *Payload) PrintInfo() {
-    fmt.Printf("\nPayload Information:\n")
-    fmt.Printf("File: %s\n", p.Filename)
-    fmt.Printf("Version: %d\n", p.header.Version)
-    fmt.Printf("Manifest Length: %d bytes\n", p.header.ManifestLen)
-    fmt.Printf("Metadata Signature Length: %d bytes\n", p.header.MetadataSignatureLen)
-    fmt.Printf("Metadata Size: %d bytes\n", p.metadataSize)
-    fmt.Printf("Data Offset: %d bytes\n", p.dataOffset)
-    
-    if p.deltaArchiveManifest != nil {
-        fmt.Printf("\nPartitions:\n")
-        for _, partition := range p.deltaArchiveManifest.Partitions {
-            fmt.Printf("- %s (%s)\n", 
-                partition.GetPartitionName(),
-                humanize.Bytes(partition.GetNewPartitionInfo().GetSize()))
-        }
-    }
+func PrintVersionInfo(w io.Writer) {
+    fmt.Fprintf(w, "Payload Dumper Go v%s\n", Version)
+    fmt.Fprintf(w, "Block Size: %d bytes\n", blockSize)
 }
 
-func (p *Payload) VerifyPayload() error {
-    if !p.initialized {
-        return errors.New("payload not initialized")
+// PrintInfo writes a human-readable description of the payload to w.
+func (p *Payload) PrintInfo(w io.Writer) {
+    fmt.Fprintf(w, "\nPayload Information:\n")
+    if p.Filename != "" {
+        fmt.Fprintf(w, "File: %s\n", p.Filename)
+    }
+    fmt.Fprintf(w, "Version: %d\n", p.header.Version)
+    fmt.Fprintf(w, "Manifest Length: %d bytes\n", p.header.ManifestLen)
+    fmt.Fprintf(w, "Metadata Signature Length: %d bytes\n", p.header.MetadataSignatureLen)
+    fmt.Fprintf(w, "Metadata Size: %d bytes\n", p.metadataSize)
+    fmt.Fprintf(w, "Data Offset: %d bytes\n", p.dataOffset)
+    
+    manifest := p.deltaArchiveManifest
+    if manifest == nil {
+        return
     }
 
-    fmt.Println("\nVerifying payload...")
-    
-    // Verify magic
-    buf := make([]byte, 4)
-    if _, err := p.file.ReadAt(buf, 0); err != nil {
-        return err
+    fmt.Fprintf(w, "Minor Version: %d\n", manifest.GetMinorVersion())
+    fmt.Fprintf(w, "Block Size: %d bytes\n", manifest.GetBlockSize())
+    if manifest.MaxTimestamp != nil {
+        fmt.Fprintf(w, "Max Timestamp: %d (%s)\n", manifest.GetMaxTimestamp(),
+            time.Unix(manifest.GetMaxTimestamp(), 0).UTC().Format(time.RFC3339))
     }
-    if string(buf) != payloadHeaderMagic {
-        return fmt.Errorf("invalid magic: %s", string(buf))
+    if manifest.SecurityPatchLevel != nil {
+        fmt.Fprintf(w, "Security Patch Level: %s\n", manifest.GetSecurityPatchLevel())
     }
+    fmt.Fprintf(w, "Partial Update: %t\n", manifest.GetPartialUpdate())
 
-    // Verify version
-    if p.header.Version != brilloMajorPayloadVersion {
-        return fmt.Errorf("unsupported version: %d", p.header.Version)
+    if metadata := manifest.GetDynamicPartitionMetadata(); metadata != nil {
+        fmt.Fprintf(w, "\nDynamic Partitions:\n")
+        fmt.Fprintf(w, "Snapshot Enabled: %t\n", metadata.GetSnapshotEnabled())
+        fmt.Fprintf(w, "VABC Enabled: %t\n", metadata.GetVabcEnabled())
+        if metadata.VabcCompressionParam != nil {
+            fmt.Fprintf(w, "VABC Compression: %s\n", metadata.GetVabcCompressionParam())
+        }
+        if metadata.CowVersion != nil {
+            fmt.Fprintf(w, "COW Version: %d\n", metadata.GetCowVersion())
+        }
+        if featureSet := metadata.GetVabcFeatureSet(); featureSet != nil {
+            fmt.Fprintf(w, "VABC Features: threaded=%t, batch_writes=%t\n", featureSet.GetThreaded(), featureSet.GetBatchWrites())
+        }
+        if metadata.CompressionFactor != nil {
+            fmt.Fprintf(w, "Compression Factor: %d\n", metadata.GetCompressionFactor())
+        }
+        for _, group := range metadata.GetGroups() {
+            fmt.Fprintf(w, "- %s (%s): %s\n",
+                group.GetName(),
+                humanize.Bytes(group.GetSize()),
+                strings.Join(group.GetPartitionNames(), ", "))
+        }
     }
 
-    // Verify manifest
-    if p.deltaArchiveManifest == nil {
-        return errors.New("manifest not loaded")
+    if len(manifest.GetApexInfo()) > 0 {
+        fmt.Fprintf(w, "\nAPEX Packages:\n")
+        for _, apex := range manifest.GetApexInfo() {
+            fmt.Fprintf(w, "- %s (version %d", apex.GetPackageName(), apex.GetVersion())
+            if apex.GetIsCompressed() {
+                fmt.Fprintf(w, ", compressed, %s decompressed", humanize.Bytes(uint64(apex.GetDecompressedSize())))
+            }
+            fmt.Fprintf(w, ")\n")
+        }
     }
 
-    return nil
+    fmt.Fprintf(w, "\nPartitions:\n")
+    for _, partition := range manifest.Partitions {
+        fmt.Fprintf(w, "- %s (%s, %d operations",
+            partition.GetPartitionName(),
+            humanize.Bytes(partition.GetNewPartitionInfo().GetSize()),
+            len(partition.GetOperations()))
+        if partition.Version != nil {
+            fmt.Fprintf(w, ", version %s", partition.GetVersion())
+        }
+        if partition.EstimateCowSize != nil {
+            fmt.Fprintf(w, ", estimated COW %s", humanize.Bytes(partition.GetEstimateCowSize()))
+        }
+        fmt.Fprintf(w, ")\n")
+    }
 }
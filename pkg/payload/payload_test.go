@@ -0,0 +1,113 @@
+package payload
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+
+    "google.golang.org/protobuf/proto"
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// openDataPayload opens a file holding only data, for extracting
+// partitions whose operations refer to it.
+func openDataPayload(t *testing.T, data []byte) *Payload {
+    filename := filepath.Join(t.TempDir(), "payload.bin")
+    if err := os.WriteFile(filename, data, 0o644); err != nil {
+        t.Fatal(err)
+    }
+    p := NewPayload(filename)
+    if err := p.Open(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { p.Close() })
+    return p
+}
+
+func testExtent(start, blocks uint64) *chromeos_update_engine.Extent {
+    return &chromeos_update_engine.Extent{StartBlock: proto.Uint64(start), NumBlocks: proto.Uint64(blocks)}
+}
+
+func TestExtractZeroesExistingFile(t *testing.T) {
+    data := bytes.Repeat([]byte{0x5A}, blockSize)
+    partition := &chromeos_update_engine.PartitionUpdate{
+        PartitionName: proto.String("system"),
+        NewPartitionInfo: &chromeos_update_engine.PartitionInfo{Size: proto.Uint64(4 * blockSize)},
+        Operations: []*chromeos_update_engine.InstallOperation{
+            {
+                Type: chromeos_update_engine.InstallOperation_REPLACE.Enum(),
+                DataOffset: proto.Uint64(0),
+                DataLength: proto.Uint64(blockSize),
+                DstExtents: []*chromeos_update_engine.Extent{testExtent(0, 1)},
+            },
+            {
+                Type: chromeos_update_engine.InstallOperation_ZERO.Enum(),
+                DstExtents: []*chromeos_update_engine.Extent{testExtent(1, 2)},
+            },
+            {
+                Type: chromeos_update_engine.InstallOperation_DISCARD.Enum(),
+                DstExtents: []*chromeos_update_engine.Extent{testExtent(3, 1)},
+            },
+        },
+    }
+
+    // out holds an older image, which the zeroed regions must not show through.
+    name := filepath.Join(t.TempDir(), "system.img")
+    if err := os.WriteFile(name, bytes.Repeat([]byte{0xFF}, 4*blockSize), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    out, err := os.OpenFile(name, os.O_RDWR, 0)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer out.Close()
+
+    p := openDataPayload(t, data)
+    if err := p.Extract(partition, out); err != nil {
+        t.Fatal(err)
+    }
+    got, err := os.ReadFile(name)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := append(data, make([]byte, 3*blockSize)...)
+    if !bytes.Equal(got, want) {
+        t.Fatal("zeroed regions kept the old data")
+    }
+}
+
+func TestExtractWriteOnlyFile(t *testing.T) {
+    data := bytes.Repeat([]byte{0x5A}, blockSize)
+    hash := sha256.Sum256(data)
+    partition := &chromeos_update_engine.PartitionUpdate{
+        PartitionName: proto.String("system"),
+        NewPartitionInfo: &chromeos_update_engine.PartitionInfo{Size: proto.Uint64(blockSize)},
+        Operations: []*chromeos_update_engine.InstallOperation{{
+            Type: chromeos_update_engine.InstallOperation_REPLACE.Enum(),
+            DataOffset: proto.Uint64(0),
+            DataLength: proto.Uint64(blockSize),
+            DstExtents: []*chromeos_update_engine.Extent{testExtent(0, 1)},
+        }},
+    }
+    p := openDataPayload(t, data)
+    name := filepath.Join(t.TempDir(), "system.img")
+    out, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0o644)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer out.Close()
+
+    // Without a hash nothing is read back.
+    if err := p.Extract(partition, out); err != nil {
+        t.Fatal(err)
+    }
+
+    partition.NewPartitionInfo.Hash = hash[:]
+    err = p.Extract(partition, out)
+    if err == nil || !strings.Contains(err.Error(), "must be open for reading and writing") {
+        t.Fatalf("got %v, want an error for a write-only file", err)
+    }
+}
@@ -0,0 +1,732 @@
+package payload
+
+import (
+    "errors"
+    "fmt"
+)
+
+// This file implements puffin's "puff" representation of deflate streams:
+// the Huffman coding is stripped from every block so that a binary diff of
+// the puffed data stays small, and it can be reversed bit-exactly.
+
+var (
+    errCorruptDeflate = errors.New("Corrupt deflate stream")
+    errCorruptPuff = errors.New("Corrupt puff stream")
+)
+
+const (
+    deflateStored = 0
+    deflateFixed = 1
+    deflateDynamic = 2
+
+    // Longest literal run a single puff literals record can describe. Longer
+    // runs are split, as puffin does.
+    maxPuffLiterals = 0xFFFF + 128
+
+    // Length of the length/distance record that marks the end of a block.
+    puffEndOfBlockLength = 259
+)
+
+var (
+    lengthBases = [29]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+    lengthExtraBits = [29]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+    distanceBases = [30]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+    distanceExtraBits = [30]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+    codeLengthOrder = [19]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+
+    fixedLitLen, fixedDistance *huffman
+)
+
+func init() {
+    lens := make([]uint8, 288)
+    for i := range lens {
+        switch {
+        case i < 144:
+            lens[i] = 8
+        case i < 256:
+            lens[i] = 9
+        case i < 280:
+            lens[i] = 7
+        default:
+            lens[i] = 8
+        }
+    }
+    fixedLitLen, _ = newHuffman(lens)
+
+    lens = make([]uint8, 30)
+    for i := range lens {
+        lens[i] = 5
+    }
+    fixedDistance, _ = newHuffman(lens)
+}
+
+// bitReader reads a deflate bit stream (least significant bit first).
+type bitReader struct {
+    buf []byte
+    pos uint64
+    end uint64
+}
+
+func (br *bitReader) remaining() uint64 {
+    return br.end - br.pos
+}
+
+// peek returns the next n bits, padding with zeros past the end of the stream.
+func (br *bitReader) peek(n uint) uint32 {
+    var v uint32
+    for i := uint(0); i < n; {
+        pos := br.pos + uint64(i)
+        if pos >= br.end {
+            break
+        }
+        shift := uint(pos % 8)
+        take := 8 - shift
+        if take > n-i {
+            take = n - i
+        }
+        v |= (uint32(br.buf[pos/8]>>shift) & (1<<take - 1)) << i
+        i += take
+    }
+    return v
+}
+
+func (br *bitReader) read(n uint) (uint32, error) {
+    if br.remaining() < uint64(n) {
+        return 0, errCorruptDeflate
+    }
+    v := br.peek(n)
+    br.pos += uint64(n)
+    return v, nil
+}
+
+// bitWriter produces a deflate bit stream (least significant bit first).
+type bitWriter struct {
+    out []byte
+    acc uint64
+    n uint
+    bits uint64
+}
+
+func (bw *bitWriter) write(n uint, v uint32) {
+    bw.acc |= uint64(v&(1<<n-1)) << bw.n
+    bw.n += n
+    bw.bits += uint64(n)
+    for bw.n >= 8 {
+        bw.out = append(bw.out, byte(bw.acc))
+        bw.acc >>= 8
+        bw.n -= 8
+    }
+}
+
+// writeBoundary fills the bits up to the next byte boundary with v.
+func (bw *bitWriter) writeBoundary(v uint32) {
+    bw.write((8-bw.n%8)%8, v)
+}
+
+// flush pads the last partial byte with zeros and returns the stream.
+func (bw *bitWriter) flush() []byte {
+    if bw.n > 0 {
+        bw.out = append(bw.out, byte(bw.acc))
+        bw.acc, bw.n = 0, 0
+    }
+    return bw.out
+}
+
+// huffman is a canonical Huffman code usable for both decoding and encoding.
+type huffman struct {
+    lens []uint8
+    codes []uint16
+    table []uint16
+    maxBits uint
+}
+
+func reverseBits(v uint16, n uint8) uint16 {
+    var r uint16
+    for i := uint8(0); i < n; i++ {
+        r = r<<1 | v&1
+        v >>= 1
+    }
+    return r
+}
+
+func newHuffman(lens []uint8) (*huffman, error) {
+    h := &huffman{
+        lens: lens,
+        codes: make([]uint16, len(lens)),
+    }
+
+    var count [16]uint16
+    for _, l := range lens {
+        if l > 15 {
+            return nil, errCorruptDeflate
+        }
+        count[l]++
+        if uint(l) > h.maxBits {
+            h.maxBits = uint(l)
+        }
+    }
+    count[0] = 0
+
+    left := 1
+    for i := 1; i < 16; i++ {
+        left = left<<1 - int(count[i])
+        if left < 0 {
+            return nil, errCorruptDeflate
+        }
+    }
+
+    var next [16]uint16
+    code := uint16(0)
+    for i := 1; i < 16; i++ {
+        code = (code + count[i-1]) << 1
+        next[i] = code
+    }
+
+    // Each table entry holds symbol<<4 | code length, indexed by the next
+    // maxBits bits of the stream; a zero entry marks an unused code.
+    h.table = make([]uint16, 1<<h.maxBits)
+    for sym, l := range lens {
+        if l == 0 {
+            continue
+        }
+        h.codes[sym] = reverseBits(next[l], l)
+        next[l]++
+        for i := uint32(h.codes[sym]); i < uint32(len(h.table)); i += 1 << l {
+            h.table[i] = uint16(sym)<<4 | uint16(l)
+        }
+    }
+    return h, nil
+}
+
+func (h *huffman) decode(br *bitReader) (uint16, error) {
+    entry := h.table[br.peek(h.maxBits)]
+    n := uint64(entry & 0xF)
+    if n == 0 || n > br.remaining() {
+        return 0, errCorruptDeflate
+    }
+    br.pos += n
+    return entry >> 4, nil
+}
+
+func (h *huffman) encode(bw *bitWriter, sym uint16) error {
+    if int(sym) >= len(h.lens) || h.lens[sym] == 0 {
+        return errCorruptPuff
+    }
+    bw.write(uint(h.lens[sym]), uint32(h.codes[sym]))
+    return nil
+}
+
+// puffWriter serializes puff records. Literals are buffered so that
+// consecutive ones are written as a single run.
+type puffWriter struct {
+    out []byte
+    literals []byte
+}
+
+func (w *puffWriter) flushLiterals() error {
+    n := len(w.literals)
+    switch {
+    case n == 0:
+        return nil
+    case n <= 127:
+        w.out = append(w.out, byte(n-1))
+    case n <= maxPuffLiterals:
+        w.out = append(w.out, 127, byte((n-128)>>8), byte(n-128))
+    default:
+        return errCorruptDeflate
+    }
+    w.out = append(w.out, w.literals...)
+    w.literals = w.literals[:0]
+    return nil
+}
+
+func (w *puffWriter) metadata(b []byte) error {
+    if err := w.flushLiterals(); err != nil {
+        return err
+    }
+    w.out = append(w.out, b...)
+    return nil
+}
+
+func (w *puffWriter) lenDist(length, distance uint16) error {
+    if err := w.flushLiterals(); err != nil {
+        return err
+    }
+    if length < 130 {
+        w.out = append(w.out, 0x80|byte(length-3))
+    } else {
+        w.out = append(w.out, 0xFF, byte(length-130))
+    }
+    w.out = append(w.out, byte((distance-1)>>8), byte(distance-1))
+    return nil
+}
+
+func (w *puffWriter) endOfBlock() error {
+    if err := w.flushLiterals(); err != nil {
+        return err
+    }
+    w.out = append(w.out, 0xFF, byte(puffEndOfBlockLength-130))
+    return nil
+}
+
+// readDynamicHeader reads the Huffman tables of a dynamic block and returns
+// them along with their compact puff encoding.
+func readDynamicHeader(br *bitReader) ([]byte, *huffman, *huffman, error) {
+    v, err := br.read(14)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    numLitLen := int(v&0x1F) + 257
+    numDistance := int(v>>5&0x1F) + 1
+    numCodes := int(v>>10) + 4
+    if numLitLen > 286 || numDistance > 30 {
+        return nil, nil, nil, errCorruptDeflate
+    }
+    meta := []byte{byte(numLitLen - 257), byte(numDistance - 1), byte(numCodes - 4)}
+
+    codeLens := make([]uint8, 19)
+    for i := 0; i < numCodes; i++ {
+        l, err := br.read(3)
+        if err != nil {
+            return nil, nil, nil, err
+        }
+        codeLens[codeLengthOrder[i]] = uint8(l)
+        if i%2 == 0 {
+            meta = append(meta, uint8(l)<<4)
+        } else {
+            meta[len(meta)-1] |= uint8(l)
+        }
+    }
+    codeHuffman, err := newHuffman(codeLens)
+    if err != nil {
+        return nil, nil, nil, err
+    }
+
+    lens := make([]uint8, 0, numLitLen+numDistance)
+    for len(lens) < numLitLen+numDistance {
+        sym, err := codeHuffman.decode(br)
+        if err != nil {
+            return nil, nil, nil, err
+        }
+        if sym < 16 {
+            meta = append(meta, byte(sym))
+            lens = append(lens, uint8(sym))
+            continue
+        }
+
+        var repeat uint32
+        value := uint8(0)
+        switch sym {
+        case 16:
+            if len(lens) == 0 {
+                return nil, nil, nil, errCorruptDeflate
+            }
+            if repeat, err = br.read(2); err != nil {
+                return nil, nil, nil, err
+            }
+            meta = append(meta, byte(16+repeat))
+            repeat += 3
+            value = lens[len(lens)-1]
+        case 17:
+            if repeat, err = br.read(3); err != nil {
+                return nil, nil, nil, err
+            }
+            meta = append(meta, byte(20+repeat))
+            repeat += 3
+        default:
+            if repeat, err = br.read(7); err != nil {
+                return nil, nil, nil, err
+            }
+            meta = append(meta, byte(28+repeat))
+            repeat += 11
+        }
+        if len(lens)+int(repeat) > numLitLen+numDistance {
+            return nil, nil, nil, errCorruptDeflate
+        }
+        for ; repeat > 0; repeat-- {
+            lens = append(lens, value)
+        }
+    }
+
+    litLen, err := newHuffman(lens[:numLitLen])
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    distance, err := newHuffman(lens[numLitLen:])
+    if err != nil {
+        return nil, nil, nil, err
+    }
+    return meta, litLen, distance, nil
+}
+
+// puffDeflate converts the deflate blocks read from br into puff records.
+func puffDeflate(br *bitReader, w *puffWriter) error {
+    for br.remaining() >= 8 {
+        v, err := br.read(3)
+        if err != nil {
+            return err
+        }
+        header := byte(v&1)<<7 | byte(v>>1)<<5
+
+        var litLen, distance *huffman
+        switch v >> 1 {
+        case deflateStored:
+            skipped, err := br.read(uint((8 - br.pos%8) % 8))
+            if err != nil {
+                return err
+            }
+            // The padding bits are kept in the low five bits of the block
+            // header, there is no room for more.
+            if skipped > 0x1F {
+                return fmt.Errorf("Unsupported stored block padding: %#x", skipped)
+            }
+            lengths, err := br.read(32)
+            if err != nil {
+                return err
+            }
+            length := uint64(lengths & 0xFFFF)
+            if length != uint64(^lengths>>16) || br.remaining() < length*8 {
+                return errCorruptDeflate
+            }
+            if err := w.metadata([]byte{header | byte(skipped)}); err != nil {
+                return err
+            }
+            w.literals = append(w.literals, br.buf[br.pos/8:br.pos/8+length]...)
+            br.pos += length * 8
+            if err := w.endOfBlock(); err != nil {
+                return err
+            }
+            continue
+
+        case deflateFixed:
+            if err := w.metadata([]byte{header}); err != nil {
+                return err
+            }
+            litLen, distance = fixedLitLen, fixedDistance
+
+        case deflateDynamic:
+            meta, l, d, err := readDynamicHeader(br)
+            if err != nil {
+                return err
+            }
+            if err := w.metadata(append([]byte{header}, meta...)); err != nil {
+                return err
+            }
+            litLen, distance = l, d
+
+        default:
+            return errCorruptDeflate
+        }
+
+        for {
+            sym, err := litLen.decode(br)
+            if err != nil {
+                return err
+            }
+            if sym < 256 {
+                w.literals = append(w.literals, byte(sym))
+                if len(w.literals) == maxPuffLiterals {
+                    if err := w.flushLiterals(); err != nil {
+                        return err
+                    }
+                }
+                continue
+            }
+            if sym == 256 {
+                if err := w.endOfBlock(); err != nil {
+                    return err
+                }
+                break
+            }
+
+            sym -= 257
+            if sym >= 29 {
+                return errCorruptDeflate
+            }
+            extra, err := br.read(uint(lengthExtraBits[sym]))
+            if err != nil {
+                return err
+            }
+            length := lengthBases[sym] + uint16(extra)
+
+            sym, err = distance.decode(br)
+            if err != nil {
+                return err
+            }
+            if sym >= 30 {
+                return errCorruptDeflate
+            }
+            if extra, err = br.read(uint(distanceExtraBits[sym])); err != nil {
+                return err
+            }
+            if length > 258 {
+                return errCorruptDeflate
+            }
+            if err := w.lenDist(length, distanceBases[sym]+uint16(extra)); err != nil {
+                return err
+            }
+        }
+    }
+    return w.flushLiterals()
+}
+
+// puffReader walks the records of a puff stream.
+type puffReader struct {
+    buf []byte
+    pos int
+}
+
+func (r *puffReader) next(n int) ([]byte, error) {
+    if len(r.buf)-r.pos < n {
+        return nil, errCorruptPuff
+    }
+    b := r.buf[r.pos : r.pos+n]
+    r.pos += n
+    return b, nil
+}
+
+// Kinds of puff records that follow the block metadata.
+const (
+    puffLiterals = iota
+    puffLenDist
+    puffEndOfBlock
+)
+
+// record reads the next literals, length/distance or end of block record.
+func (r *puffReader) record() (kind int, literals []byte, length, distance uint16, err error) {
+    b, err := r.next(1)
+    if err != nil {
+        return 0, nil, 0, 0, err
+    }
+
+    if b[0]&0x80 == 0 {
+        n := int(b[0]) + 1
+        if b[0] == 127 {
+            if b, err = r.next(2); err != nil {
+                return 0, nil, 0, 0, err
+            }
+            n = int(b[0])<<8 | int(b[1]) + 128
+        }
+        literals, err = r.next(n)
+        return puffLiterals, literals, 0, 0, err
+    }
+
+    length = uint16(b[0]&0x7F) + 3
+    if b[0] == 0xFF {
+        if b, err = r.next(1); err != nil {
+            return 0, nil, 0, 0, err
+        }
+        length = uint16(b[0]) + 130
+        if length == puffEndOfBlockLength {
+            return puffEndOfBlock, nil, 0, 0, nil
+        }
+        if length > 258 {
+            return 0, nil, 0, 0, errCorruptPuff
+        }
+    }
+    if b, err = r.next(2); err != nil {
+        return 0, nil, 0, 0, err
+    }
+    distance = (uint16(b[0])<<8 | uint16(b[1])) + 1
+    if distance > 32768 {
+        return 0, nil, 0, 0, errCorruptPuff
+    }
+    return puffLenDist, nil, length, distance, nil
+}
+
+// writeDynamicHeader rebuilds the Huffman tables of a dynamic block from
+// their puff encoding and writes the deflate block header for them.
+func writeDynamicHeader(r *puffReader, bw *bitWriter) (*huffman, *huffman, error) {
+    b, err := r.next(3)
+    if err != nil {
+        return nil, nil, err
+    }
+    numLitLen := int(b[0]) + 257
+    numDistance := int(b[1]) + 1
+    numCodes := int(b[2]) + 4
+    if numLitLen > 286 || numDistance > 30 || numCodes > 19 {
+        return nil, nil, errCorruptPuff
+    }
+    bw.write(5, uint32(b[0]))
+    bw.write(5, uint32(b[1]))
+    bw.write(4, uint32(b[2]))
+
+    packed, err := r.next((numCodes + 1) / 2)
+    if err != nil {
+        return nil, nil, err
+    }
+    codeLens := make([]uint8, 19)
+    for i := 0; i < numCodes; i++ {
+        l := packed[i/2] >> 4
+        if i%2 == 1 {
+            l = packed[i/2] & 0x0F
+        }
+        if l > 7 {
+            return nil, nil, errCorruptPuff
+        }
+        codeLens[codeLengthOrder[i]] = l
+        bw.write(3, uint32(l))
+    }
+    codeHuffman, err := newHuffman(codeLens)
+    if err != nil {
+        return nil, nil, errCorruptPuff
+    }
+
+    lens := make([]uint8, 0, numLitLen+numDistance)
+    for len(lens) < numLitLen+numDistance {
+        b, err := r.next(1)
+        if err != nil {
+            return nil, nil, err
+        }
+        c := b[0]
+
+        var repeat int
+        value := uint8(0)
+        switch {
+        case c < 16:
+            if err := codeHuffman.encode(bw, uint16(c)); err != nil {
+                return nil, nil, err
+            }
+            lens = append(lens, c)
+            continue
+        case c < 20:
+            if len(lens) == 0 {
+                return nil, nil, errCorruptPuff
+            }
+            if err := codeHuffman.encode(bw, 16); err != nil {
+                return nil, nil, err
+            }
+            bw.write(2, uint32(c-16))
+            repeat, value = int(c-16)+3, lens[len(lens)-1]
+        case c < 28:
+            if err := codeHuffman.encode(bw, 17); err != nil {
+                return nil, nil, err
+            }
+            bw.write(3, uint32(c-20))
+            repeat = int(c-20) + 3
+        case c < 156:
+            if err := codeHuffman.encode(bw, 18); err != nil {
+                return nil, nil, err
+            }
+            bw.write(7, uint32(c-28))
+            repeat = int(c-28) + 11
+        default:
+            return nil, nil, errCorruptPuff
+        }
+        if len(lens)+repeat > numLitLen+numDistance {
+            return nil, nil, errCorruptPuff
+        }
+        for ; repeat > 0; repeat-- {
+            lens = append(lens, value)
+        }
+    }
+
+    litLen, err := newHuffman(lens[:numLitLen])
+    if err != nil {
+        return nil, nil, errCorruptPuff
+    }
+    distance, err := newHuffman(lens[numLitLen:])
+    if err != nil {
+        return nil, nil, errCorruptPuff
+    }
+    return litLen, distance, nil
+}
+
+// huffDeflate converts puff records back into deflate blocks.
+func huffDeflate(r *puffReader, bw *bitWriter) error {
+    for r.pos < len(r.buf) {
+        b, err := r.next(1)
+        if err != nil {
+            return err
+        }
+        header := b[0]
+        bw.write(1, uint32(header>>7))
+        bw.write(2, uint32(header>>5&3))
+
+        var litLen, distance *huffman
+        switch header >> 5 & 3 {
+        case deflateStored:
+            bw.writeBoundary(uint32(header & 0x1F))
+            kind, literals, _, _, err := r.record()
+            if err != nil {
+                return err
+            }
+            if kind == puffLiterals {
+                if len(literals) > 0xFFFF {
+                    return errCorruptPuff
+                }
+                bw.write(16, uint32(len(literals)))
+                bw.write(16, ^uint32(len(literals)))
+                for _, c := range literals {
+                    bw.write(8, uint32(c))
+                }
+                if kind, _, _, _, err = r.record(); err != nil {
+                    return err
+                }
+            } else {
+                bw.write(16, 0)
+                bw.write(16, 0xFFFF)
+            }
+            if kind != puffEndOfBlock {
+                return errCorruptPuff
+            }
+            continue
+
+        case deflateFixed:
+            litLen, distance = fixedLitLen, fixedDistance
+
+        case deflateDynamic:
+            if litLen, distance, err = writeDynamicHeader(r, bw); err != nil {
+                return err
+            }
+
+        default:
+            return errCorruptPuff
+        }
+
+        for ended := false; !ended; {
+            kind, literals, length, dist, err := r.record()
+            if err != nil {
+                return err
+            }
+
+            switch kind {
+            case puffLiterals:
+                for _, c := range literals {
+                    if err := litLen.encode(bw, uint16(c)); err != nil {
+                        return err
+                    }
+                }
+
+            case puffLenDist:
+                i := 0
+                for i+1 < len(lengthBases) && lengthBases[i+1] <= length {
+                    i++
+                }
+                if err := litLen.encode(bw, uint16(257+i)); err != nil {
+                    return err
+                }
+                bw.write(uint(lengthExtraBits[i]), uint32(length-lengthBases[i]))
+
+                i = 0
+                for i+1 < len(distanceBases) && distanceBases[i+1] <= dist {
+                    i++
+                }
+                if err := distance.encode(bw, uint16(i)); err != nil {
+                    return err
+                }
+                bw.write(uint(distanceExtraBits[i]), uint32(dist-distanceBases[i]))
+
+            case puffEndOfBlock:
+                if err := litLen.encode(bw, 256); err != nil {
+                    return err
+                }
+                ended = true
+
+            default:
+                return fmt.Errorf("Unexpected puff record: %d", kind)
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,131 @@
+package payload
+
+import (
+    "bytes"
+    "testing"
+)
+
+func puff(t *testing.T, deflate []byte, offset uint64) []byte {
+    t.Helper()
+    w := &puffWriter{}
+    if err := puffDeflate(&bitReader{buf: deflate, pos: offset, end: uint64(len(deflate)) * 8}, w); err != nil {
+        t.Fatal(err)
+    }
+    return w.out
+}
+
+func huff(t *testing.T, puffed []byte) []byte {
+    t.Helper()
+    bw := &bitWriter{}
+    if err := huffDeflate(&puffReader{buf: puffed}, bw); err != nil {
+        t.Fatal(err)
+    }
+    return bw.flush()
+}
+
+// fixedBlock writes a final fixed Huffman block with the given literals
+// followed by a copy of length 9 at distance 1.
+func fixedBlock(literals []byte) []byte {
+    bw := &bitWriter{}
+    bw.write(1, 1)
+    bw.write(2, deflateFixed)
+    for _, c := range literals {
+        fixedLitLen.encode(bw, uint16(c))
+    }
+    fixedLitLen.encode(bw, 257+6)
+    fixedDistance.encode(bw, 0)
+    fixedLitLen.encode(bw, 256)
+    return bw.flush()
+}
+
+// The expected puffs below follow puffin's format: literal runs are prefixed
+// with their length minus one (or 127 and the length minus 128 as a big
+// endian uint16), copies with 0x80 | (length - 3) and the distance minus one,
+// and the end of a block is a copy of length 259 without a distance.
+func TestPuffGolden(t *testing.T) {
+    tests := []struct {
+        name    string
+        deflate []byte
+        puff    []byte
+    }{
+        {
+            name:    "empty fixed block",
+            deflate: []byte{0x03, 0x00},
+            puff:    []byte{0xA0, 0xFF, 0x81},
+        },
+        {
+            name:    "stored block",
+            deflate: []byte{0x01, 0x03, 0x00, 0xFC, 0xFF, 'a', 'b', 'c'},
+            puff:    []byte{0x80, 0x02, 'a', 'b', 'c', 0xFF, 0x81},
+        },
+        {
+            name:    "fixed block",
+            deflate: fixedBlock([]byte("a")),
+            puff:    []byte{0xA0, 0x00, 'a', 0x86, 0x00, 0x00, 0xFF, 0x81},
+        },
+    }
+    for _, test := range tests {
+        t.Run(test.name, func(t *testing.T) {
+            puffed := puff(t, test.deflate, 0)
+            if !bytes.Equal(puffed, test.puff) {
+                t.Fatalf("puff = %x, want %x", puffed, test.puff)
+            }
+            if deflate := huff(t, puffed); !bytes.Equal(deflate, test.deflate) {
+                t.Fatalf("huff = %x, want %x", deflate, test.deflate)
+            }
+        })
+    }
+}
+
+func TestPuffLongLiteralRun(t *testing.T) {
+    literals := make([]byte, maxPuffLiterals+4337)
+    for i := range literals {
+        literals[i] = byte(i * 7)
+    }
+    deflate := fixedBlock(literals)
+
+    puffed := puff(t, deflate, 0)
+    first := 1
+    second := first + 3 + maxPuffLiterals
+    if !bytes.Equal(puffed[first:first+3], []byte{127, 0xFF, 0xFF}) {
+        t.Fatalf("first run header = %x", puffed[first:first+3])
+    }
+    if !bytes.Equal(puffed[second:second+3], []byte{127, 0x10, 0x71}) {
+        t.Fatalf("second run header = %x", puffed[second:second+3])
+    }
+    if !bytes.Equal(huff(t, puffed), deflate) {
+        t.Fatal("huff does not reproduce the deflate stream")
+    }
+}
+
+func TestPuffStoredPadding(t *testing.T) {
+    // A stored block header that starts six bits into a byte is followed by
+    // seven padding bits.
+    stored := func(padding uint32) []byte {
+        bw := &bitWriter{}
+        bw.write(6, 0)
+        bw.write(1, 1)
+        bw.write(2, deflateStored)
+        bw.writeBoundary(padding)
+        bw.write(16, 0)
+        bw.write(16, 0xFFFF)
+        return bw.flush()
+    }
+
+    if puffed := puff(t, stored(0x1F), 6); !bytes.Equal(puffed, []byte{0x9F, 0xFF, 0x81}) {
+        t.Fatalf("puff = %x", puffed)
+    }
+    deflate := stored(0x7F)
+    err := puffDeflate(&bitReader{buf: deflate, pos: 6, end: uint64(len(deflate)) * 8}, &puffWriter{})
+    if err == nil {
+        t.Fatal("expected an error for padding that does not fit the block header")
+    }
+}
+
+func TestParsePuffinPatchShort(t *testing.T) {
+    for _, patch := range [][]byte{nil, []byte("PU"), []byte("PUF1")} {
+        if _, _, _, _, err := parsePuffinPatch(patch); err == nil {
+            t.Fatalf("expected an error for %q", patch)
+        }
+    }
+}
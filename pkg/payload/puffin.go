@@ -0,0 +1,298 @@
+package payload
+
+import (
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+
+    "google.golang.org/protobuf/encoding/protowire"
+)
+
+const puffinMagic = "PUF1"
+
+// Patch types of puffin.metadata.PatchHeader.
+const (
+    puffinPatchBsdiff = 0
+    puffinPatchZucchini = 1
+)
+
+// maxPuffExpansion bounds the size of puffed data relative to the data it was
+// puffed from. A puff record takes at most four bytes and stands for at least
+// two bits of deflate data.
+const maxPuffExpansion = 16
+
+var errCorruptPuffinPatch = errors.New("Corrupt puffin patch")
+
+type extent struct {
+    offset uint64
+    length uint64
+}
+
+// puffinStreamInfo describes the deflate streams of a file, as bit extents in
+// the file, and where their puffs live in the puffed file, as byte extents.
+type puffinStreamInfo struct {
+    deflates []extent
+    puffs []extent
+    puffLength uint64
+}
+
+// consumeMessage calls fn for every field of the protobuf message in b.
+func consumeMessage(b []byte, fn func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+    for len(b) > 0 {
+        num, typ, n := protowire.ConsumeTag(b)
+        if n < 0 {
+            return protowire.ParseError(n)
+        }
+        b = b[n:]
+        n, err := fn(num, typ, b)
+        if err != nil {
+            return err
+        }
+        if n == 0 {
+            n = protowire.ConsumeFieldValue(num, typ, b)
+        }
+        if n < 0 {
+            return protowire.ParseError(n)
+        }
+        b = b[n:]
+    }
+    return nil
+}
+
+func parsePuffinExtent(b []byte, unit uint64) (extent, error) {
+    var e extent
+    err := consumeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+        if typ != protowire.VarintType || (num != 1 && num != 2) {
+            return 0, nil
+        }
+        v, n := protowire.ConsumeVarint(b)
+        if num == 1 {
+            e.offset = v / unit
+        } else {
+            e.length = v / unit
+        }
+        return n, nil
+    })
+    return e, err
+}
+
+func parsePuffinStreamInfo(b []byte) (*puffinStreamInfo, error) {
+    info := &puffinStreamInfo{}
+    err := consumeMessage(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+        switch {
+        case (num == 1 || num == 2) && typ == protowire.BytesType:
+            v, n := protowire.ConsumeBytes(b)
+            if n < 0 {
+                return n, nil
+            }
+            // Deflates are stored in bits, puffs in bytes expressed as bits.
+            if num == 1 {
+                e, err := parsePuffinExtent(v, 1)
+                info.deflates = append(info.deflates, e)
+                return n, err
+            }
+            e, err := parsePuffinExtent(v, 8)
+            info.puffs = append(info.puffs, e)
+            return n, err
+        case num == 3 && typ == protowire.VarintType:
+            v, n := protowire.ConsumeVarint(b)
+            info.puffLength = v
+            return n, nil
+        }
+        return 0, nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if len(info.deflates) != len(info.puffs) {
+        return nil, errCorruptPuffinPatch
+    }
+    return info, nil
+}
+
+// parsePuffinPatch splits a puffin patch into its header and the raw patch
+// that transforms the puffed source into the puffed destination.
+func parsePuffinPatch(patch []byte) (src *puffinStreamInfo, dst *puffinStreamInfo, patchType uint64, raw []byte, err error) {
+    if len(patch) < len(puffinMagic)+4 {
+        return nil, nil, 0, nil, errCorruptPuffinPatch
+    }
+    if string(patch[:len(puffinMagic)]) != puffinMagic {
+        return nil, nil, 0, nil, fmt.Errorf("Invalid puffin magic: %q", patch[:len(puffinMagic)])
+    }
+    headerSize := uint64(binary.BigEndian.Uint32(patch[len(puffinMagic):]))
+    patch = patch[len(puffinMagic)+4:]
+    if headerSize > uint64(len(patch)) {
+        return nil, nil, 0, nil, errCorruptPuffinPatch
+    }
+
+    err = consumeMessage(patch[:headerSize], func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+        switch {
+        case (num == 2 || num == 3) && typ == protowire.BytesType:
+            v, n := protowire.ConsumeBytes(b)
+            if n < 0 {
+                return n, nil
+            }
+            info, err := parsePuffinStreamInfo(v)
+            if num == 2 {
+                src = info
+            } else {
+                dst = info
+            }
+            return n, err
+        case num == 4 && typ == protowire.VarintType:
+            v, n := protowire.ConsumeVarint(b)
+            patchType = v
+            return n, nil
+        }
+        return 0, nil
+    })
+    if err != nil {
+        return nil, nil, 0, nil, err
+    }
+    if src == nil {
+        src = &puffinStreamInfo{}
+    }
+    if dst == nil {
+        dst = &puffinStreamInfo{}
+    }
+    return src, dst, patchType, patch[headerSize:], nil
+}
+
+// sharesLastByte reports whether the deflate following deflates[i] starts in
+// the byte that deflates[i] ends in.
+func sharesLastByte(deflates []extent, i int) bool {
+    if i+1 >= len(deflates) {
+        return false
+    }
+    end := deflates[i].offset + deflates[i].length
+    return deflates[i+1].offset < (end+7)/8*8
+}
+
+// puffStream replaces every deflate stream of data with its puff.
+func puffStream(ctx context.Context, data []byte, info *puffinStreamInfo) ([]byte, error) {
+    out := make([]byte, 0, info.puffLength)
+    next := uint64(0)
+    for i, d := range info.deflates {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        startByte := d.offset / 8
+        endByte := (d.offset + d.length + 7) / 8
+        if endByte > uint64(len(data)) || (i > 0 && d.offset < info.deflates[i-1].offset+info.deflates[i-1].length) ||
+            (startByte < next && !sharesLastByte(info.deflates, i-1)) {
+            return nil, errCorruptPuffinPatch
+        }
+        if startByte > next {
+            out = append(out, data[next:startByte]...)
+        }
+        if uint64(len(out)) != info.puffs[i].offset {
+            return nil, fmt.Errorf("Puff offset mismatch: %d != %d", len(out), info.puffs[i].offset)
+        }
+
+        br := &bitReader{
+            buf: data[startByte:endByte],
+            pos: d.offset % 8,
+            end: (endByte - startByte) * 8,
+        }
+        w := &puffWriter{out: out}
+        if err := puffDeflate(br, w); err != nil {
+            return nil, err
+        }
+        if br.pos != d.offset%8+d.length {
+            return nil, fmt.Errorf("Deflate length mismatch: %d != %d", br.pos-d.offset%8, d.length)
+        }
+        out = w.out
+        if uint64(len(out))-info.puffs[i].offset != info.puffs[i].length {
+            return nil, fmt.Errorf("Puff size mismatch: %d != %d", uint64(len(out))-info.puffs[i].offset, info.puffs[i].length)
+        }
+        next = endByte
+    }
+    if next < uint64(len(data)) {
+        out = append(out, data[next:]...)
+    }
+    if uint64(len(out)) != info.puffLength {
+        return nil, fmt.Errorf("Puff stream size mismatch: %d != %d", len(out), info.puffLength)
+    }
+    return out, nil
+}
+
+// huffStream turns every puff of puffed back into its deflate stream.
+func huffStream(ctx context.Context, puffed []byte, info *puffinStreamInfo) ([]byte, error) {
+    if uint64(len(puffed)) != info.puffLength {
+        return nil, fmt.Errorf("Puff stream size mismatch: %d != %d", len(puffed), info.puffLength)
+    }
+
+    var out []byte
+    var lastByte byte
+    shared := false
+    next := uint64(0)
+    for i, d := range info.deflates {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        puff := info.puffs[i]
+        if puff.offset < next || puff.offset+puff.length > uint64(len(puffed)) ||
+            (shared && puff.offset != next) {
+            return nil, errCorruptPuffinPatch
+        }
+        out = append(out, puffed[next:puff.offset]...)
+        if uint64(len(out)) != d.offset/8 {
+            return nil, fmt.Errorf("Deflate offset mismatch: %d != %d", len(out), d.offset/8)
+        }
+
+        bw := &bitWriter{}
+        prefix := uint(d.offset % 8)
+        if shared {
+            bw.write(prefix, uint32(lastByte))
+        } else {
+            bw.write(prefix, 0)
+        }
+        if err := huffDeflate(&puffReader{buf: puffed[puff.offset : puff.offset+puff.length]}, bw); err != nil {
+            return nil, err
+        }
+        if bw.bits != uint64(prefix)+d.length {
+            return nil, fmt.Errorf("Deflate length mismatch: %d != %d", bw.bits-uint64(prefix), d.length)
+        }
+
+        deflate := bw.flush()
+        shared = sharesLastByte(info.deflates, i)
+        if shared {
+            lastByte = deflate[len(deflate)-1]
+            deflate = deflate[:len(deflate)-1]
+        }
+        out = append(out, deflate...)
+        next = puff.offset + puff.length
+    }
+    return append(out, puffed[next:]...), nil
+}
+
+// puffpatch applies a puffin patch to old and returns the new data, which may
+// not be larger than limit. It stops with ctx.Err() once ctx is done.
+func puffpatch(ctx context.Context, old []byte, patch []byte, limit int64) ([]byte, error) {
+    src, dst, patchType, raw, err := parsePuffinPatch(patch)
+    if err != nil {
+        return nil, err
+    }
+    apply := bspatch
+    switch patchType {
+    case puffinPatchBsdiff:
+    case puffinPatchZucchini:
+        apply = zucchinipatch
+    default:
+        return nil, fmt.Errorf("Unsupported puffin patch type: %d", patchType)
+    }
+
+    puffedOld, err := puffStream(ctx, old, src)
+    if err != nil {
+        return nil, err
+    }
+    if dst.puffLength > uint64(limit)*maxPuffExpansion {
+        return nil, fmt.Errorf("Puffed data is too large: %d > %d", dst.puffLength, uint64(limit)*maxPuffExpansion)
+    }
+    puffedNew, err := apply(ctx, puffedOld, raw, int64(dst.puffLength))
+    if err != nil {
+        return nil, err
+    }
+    return huffStream(ctx, puffedNew, dst)
+}
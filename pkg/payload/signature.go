@@ -0,0 +1,188 @@
+package payload
+
+import (
+    "archive/zip"
+    "crypto"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+
+    "google.golang.org/protobuf/proto"
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// ErrSignatureMismatch is returned when none of the signatures of a payload
+// could be verified with any of the given keys.
+var ErrSignatureMismatch = errors.New("Signature verification failed")
+
+// LoadPublicKeys reads RSA public keys from a PEM file holding public keys or
+// X.509 certificates, or from an otacerts.zip holding PEM certificates.
+func LoadPublicKeys(filename string) ([]*rsa.PublicKey, error) {
+    if zipReader, err := zip.OpenReader(filename); err == nil {
+        defer zipReader.Close()
+
+        var keys []*rsa.PublicKey
+        for _, file := range zipReader.File {
+            if file.FileInfo().IsDir() {
+                continue
+            }
+            r, err := file.Open()
+            if err != nil {
+                return nil, err
+            }
+            data, err := io.ReadAll(r)
+            r.Close()
+            if err != nil {
+                return nil, err
+            }
+            fileKeys, err := parsePublicKeys(data)
+            if err != nil {
+                return nil, fmt.Errorf("%s: %w", file.Name, err)
+            }
+            keys = append(keys, fileKeys...)
+        }
+        if len(keys) == 0 {
+            return nil, fmt.Errorf("No public keys found in %s", filename)
+        }
+        return keys, nil
+    }
+
+    data, err := os.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+    keys, err := parsePublicKeys(data)
+    if err != nil {
+        return nil, err
+    }
+    if len(keys) == 0 {
+        return nil, fmt.Errorf("No public keys found in %s", filename)
+    }
+    return keys, nil
+}
+
+func parsePublicKeys(data []byte) ([]*rsa.PublicKey, error) {
+    var keys []*rsa.PublicKey
+    for {
+        var block *pem.Block
+        block, data = pem.Decode(data)
+        if block == nil {
+            return keys, nil
+        }
+
+        var key interface{}
+        var err error
+        switch block.Type {
+        case "CERTIFICATE":
+            var cert *x509.Certificate
+            if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+                key = cert.PublicKey
+            }
+        case "PUBLIC KEY":
+            key, err = x509.ParsePKIXPublicKey(block.Bytes)
+        case "RSA PUBLIC KEY":
+            key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+        default:
+            continue
+        }
+        if err != nil {
+            return nil, err
+        }
+
+        rsaKey, ok := key.(*rsa.PublicKey)
+        if !ok {
+            return nil, fmt.Errorf("Unsupported public key type: %T", key)
+        }
+        keys = append(keys, rsaKey)
+    }
+}
+
+// verifySignatures checks whether any of the signatures is a PKCS#1 v1.5
+// SHA-256 signature of hash made by any of the keys.
+func verifySignatures(signatures *chromeos_update_engine.Signatures, hash []byte, keys []*rsa.PublicKey) error {
+    if len(signatures.GetSignatures()) == 0 {
+        return errors.New("No signatures found")
+    }
+    for _, signature := range signatures.GetSignatures() {
+        data := signature.GetData()
+        if size := signature.GetUnpaddedSignatureSize(); size > 0 && int(size) <= len(data) {
+            data = data[:size]
+        }
+        for _, key := range keys {
+            if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash, data) == nil {
+                return nil
+            }
+        }
+    }
+    return ErrSignatureMismatch
+}
+
+func (p *Payload) readPayloadSignatures() (*chromeos_update_engine.Signatures, error) {
+    size := p.deltaArchiveManifest.GetSignaturesSize()
+    if size == 0 {
+        return nil, errors.New("Payload is not signed")
+    }
+    buf, err := p.readDataBlob(int64(p.deltaArchiveManifest.GetSignaturesOffset()), int64(size))
+    if err != nil {
+        return nil, err
+    }
+    signatures := &chromeos_update_engine.Signatures{}
+    if err := proto.Unmarshal(buf, signatures); err != nil {
+        return nil, err
+    }
+    return signatures, nil
+}
+
+// VerifyMetadataSignature checks the metadata signature, which covers the
+// payload header and the manifest.
+func (p *Payload) VerifyMetadataSignature(keys []*rsa.PublicKey) error {
+    if !p.initialized {
+        return errors.New("Payload has not been initialized")
+    }
+    if p.header.MetadataSignatureLen == 0 {
+        return errors.New("Payload metadata is not signed")
+    }
+
+    h := sha256.New()
+    if _, err := io.Copy(h, io.NewSectionReader(p.reader, 0, p.metadataSize)); err != nil {
+        return err
+    }
+    if err := verifySignatures(p.signatures, h.Sum(nil), keys); err != nil {
+        return fmt.Errorf("Metadata: %w", err)
+    }
+    return nil
+}
+
+// VerifyPayloadSignature checks the payload signature, which covers the whole
+// payload except the metadata signature and the payload signature itself.
+func (p *Payload) VerifyPayloadSignature(keys []*rsa.PublicKey) error {
+    if !p.initialized {
+        return errors.New("Payload has not been initialized")
+    }
+    if p.stream != nil {
+        return fmt.Errorf("Payload signature verification: %w", ErrStreamUnsupported)
+    }
+
+    signatures, err := p.readPayloadSignatures()
+    if err != nil {
+        return err
+    }
+
+    h := sha256.New()
+    if _, err := io.Copy(h, io.NewSectionReader(p.reader, 0, p.metadataSize)); err != nil {
+        return err
+    }
+    dataLength := int64(p.deltaArchiveManifest.GetSignaturesOffset())
+    if _, err := io.Copy(h, io.NewSectionReader(p.reader, p.dataOffset, dataLength)); err != nil {
+        return err
+    }
+    if err := verifySignatures(signatures, h.Sum(nil), keys); err != nil {
+        return fmt.Errorf("Payload: %w", err)
+    }
+    return nil
+}
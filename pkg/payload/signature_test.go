@@ -0,0 +1,221 @@
+package payload
+
+import (
+    "archive/zip"
+    "bytes"
+    "crypto"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "crypto/x509/pkix"
+    "encoding/binary"
+    "encoding/pem"
+    "errors"
+    "math/big"
+    "os"
+    "path/filepath"
+    "testing"
+    "time"
+
+    "google.golang.org/protobuf/proto"
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// signatureTestPadding is appended to the payload signature, which then
+// relies on unpadded_signature_size.
+const signatureTestPadding = 16
+
+func testSignatures(key *rsa.PrivateKey, hash []byte, padding int) []byte {
+    data := make([]byte, key.Size())
+    if hash != nil {
+        var err error
+        if data, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash); err != nil {
+            panic(err)
+        }
+    }
+    signatures, err := proto.Marshal(&chromeos_update_engine.Signatures{
+        Signatures: []*chromeos_update_engine.Signatures_Signature{{
+            Data: append(data, make([]byte, padding)...),
+            UnpaddedSignatureSize: proto.Uint32(uint32(key.Size())),
+        }},
+    })
+    if err != nil {
+        panic(err)
+    }
+    return signatures
+}
+
+// signedTestPayload returns a payload with a metadata and a payload
+// signature made with key. Signatures have a fixed size, so the signature
+// sizes are known before the data they cover.
+func signedTestPayload(t *testing.T, key *rsa.PrivateKey) []byte {
+    data := bytes.Repeat([]byte("signed data "), 1000)
+    manifest, err := proto.Marshal(&chromeos_update_engine.DeltaArchiveManifest{
+        BlockSize: proto.Uint32(blockSize),
+        SignaturesOffset: proto.Uint64(uint64(len(data))),
+        SignaturesSize: proto.Uint64(uint64(len(testSignatures(key, nil, signatureTestPadding)))),
+        Partitions: []*chromeos_update_engine.PartitionUpdate{{
+            PartitionName: proto.String("system"),
+            NewPartitionInfo: &chromeos_update_engine.PartitionInfo{Size: proto.Uint64(0)},
+        }},
+    })
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    header := make([]byte, 24)
+    copy(header, payloadHeaderMagic)
+    binary.BigEndian.PutUint64(header[4:], brilloMajorPayloadVersion)
+    binary.BigEndian.PutUint64(header[12:], uint64(len(manifest)))
+    binary.BigEndian.PutUint32(header[20:], uint32(len(testSignatures(key, nil, 0))))
+    metadata := concat(header, manifest)
+
+    metadataHash := sha256.Sum256(metadata)
+    payloadHash := sha256.Sum256(concat(metadata, data))
+    return concat(metadata, testSignatures(key, metadataHash[:], 0), data, testSignatures(key, payloadHash[:], signatureTestPadding))
+}
+
+func openTestPayload(t *testing.T, data []byte) *Payload {
+    filename := filepath.Join(t.TempDir(), "payload.bin")
+    if err := os.WriteFile(filename, data, 0o644); err != nil {
+        t.Fatal(err)
+    }
+    p := NewPayload(filename)
+    if err := p.Open(); err != nil {
+        t.Fatal(err)
+    }
+    t.Cleanup(func() { p.Close() })
+    if err := p.Init(); err != nil {
+        t.Fatal(err)
+    }
+    return p
+}
+
+func TestVerifySignatures(t *testing.T) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    other, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    keys := []*rsa.PublicKey{&other.PublicKey, &key.PublicKey}
+
+    valid := signedTestPayload(t, key)
+    p := openTestPayload(t, valid)
+    metadataEnd := int(p.metadataSize)
+    dataStart := int(p.dataOffset)
+    tests := []struct {
+        name             string
+        offset           int
+        metadata, payload bool
+    }{
+        {"valid", -1, true, true},
+        // The s of "system".
+        {"manifest", bytes.Index(valid, []byte("system")), false, false},
+        {"data", dataStart + 100, true, false},
+        // The metadata signature is not covered by the payload signature.
+        {"metadata signature", metadataEnd + 20, false, true},
+    }
+    for _, test := range tests {
+        data := append([]byte(nil), valid...)
+        if test.offset >= 0 {
+            data[test.offset] ^= 0x01
+        }
+        p := openTestPayload(t, data)
+        if err := p.VerifyMetadataSignature(keys); (err == nil) != test.metadata || (err != nil && !errors.Is(err, ErrSignatureMismatch)) {
+            t.Errorf("%s: metadata signature: %v", test.name, err)
+        }
+        if err := p.VerifyPayloadSignature(keys); (err == nil) != test.payload || (err != nil && !errors.Is(err, ErrSignatureMismatch)) {
+            t.Errorf("%s: payload signature: %v", test.name, err)
+        }
+    }
+
+    if err := p.VerifyPayloadSignature([]*rsa.PublicKey{&other.PublicKey}); !errors.Is(err, ErrSignatureMismatch) {
+        t.Errorf("got %v for the wrong key, want ErrSignatureMismatch", err)
+    }
+}
+
+func TestVerifySignatureUnpaddedSize(t *testing.T) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    hash := sha256.Sum256([]byte("payload"))
+    signatures := &chromeos_update_engine.Signatures{}
+    if err := proto.Unmarshal(testSignatures(key, hash[:], signatureTestPadding), signatures); err != nil {
+        t.Fatal(err)
+    }
+    keys := []*rsa.PublicKey{&key.PublicKey}
+    if err := verifySignatures(signatures, hash[:], keys); err != nil {
+        t.Fatalf("padded signature: %v", err)
+    }
+
+    // Without the unpadded size the padding is part of the signature.
+    signatures.Signatures[0].UnpaddedSignatureSize = nil
+    if err := verifySignatures(signatures, hash[:], keys); !errors.Is(err, ErrSignatureMismatch) {
+        t.Fatalf("got %v without the unpadded size, want ErrSignatureMismatch", err)
+    }
+}
+
+func TestLoadPublicKeys(t *testing.T) {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+    dir := t.TempDir()
+
+    // otacerts.zip holds the X.509 certificates of the release keys.
+    template := &x509.Certificate{
+        SerialNumber: big.NewInt(1),
+        Subject:      pkix.Name{CommonName: "Android"},
+        NotBefore:    time.Unix(0, 0),
+        NotAfter:     time.Unix(0, 0).AddDate(100, 0, 0),
+    }
+    cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+    if err != nil {
+        t.Fatal(err)
+    }
+    var otacerts bytes.Buffer
+    zw := zip.NewWriter(&otacerts)
+    w, err := zw.Create("releasekey.x509.pem")
+    if err != nil {
+        t.Fatal(err)
+    }
+    pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: cert})
+    if err := zw.Close(); err != nil {
+        t.Fatal(err)
+    }
+
+    der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+    if err != nil {
+        t.Fatal(err)
+    }
+    files := map[string][]byte{
+        "otacerts.zip": otacerts.Bytes(),
+        "key.pem":      pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}),
+    }
+
+    p := openTestPayload(t, signedTestPayload(t, key))
+    for name, data := range files {
+        filename := filepath.Join(dir, name)
+        if err := os.WriteFile(filename, data, 0o644); err != nil {
+            t.Fatal(err)
+        }
+        keys, err := LoadPublicKeys(filename)
+        if err != nil {
+            t.Fatalf("%s: %v", name, err)
+        }
+        if len(keys) != 1 || !keys[0].Equal(&key.PublicKey) {
+            t.Fatalf("%s: got %d keys, want the test key", name, len(keys))
+        }
+        if err := p.VerifyMetadataSignature(keys); err != nil {
+            t.Errorf("%s: %v", name, err)
+        }
+        if err := p.VerifyPayloadSignature(keys); err != nil {
+            t.Errorf("%s: %v", name, err)
+        }
+    }
+}
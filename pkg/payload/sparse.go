@@ -0,0 +1,152 @@
+package payload
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "io"
+
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// Android sparse image format, as written by libsparse.
+const (
+    sparseHeaderMagic   = 0xed26ff3a
+    sparseHeaderSize    = 28
+    sparseChunkSize     = 12
+    sparseChunkRaw      = 0xcac1
+    sparseChunkFill     = 0xcac2
+    sparseChunkDontCare = 0xcac3
+
+    // sparseMaxRawBlocks keeps RAW chunks well below the 4 GiB limit of the
+    // chunk size field.
+    sparseMaxRawBlocks = 16384
+)
+
+type sparseChunk struct {
+    chunkType uint16
+    start     uint32
+    blocks    uint32
+    fill      uint32
+}
+
+// partitionCoverage marks the blocks of the partition that get written by
+// its operations or by the verity data.
+func partitionCoverage(partition *chromeos_update_engine.PartitionUpdate, totalBlocks uint64) []bool {
+    covered := make([]bool, totalBlocks)
+    mark := func(e *chromeos_update_engine.Extent) {
+        for b := e.GetStartBlock(); b < e.GetStartBlock()+e.GetNumBlocks() && b < totalBlocks; b++ {
+            covered[b] = true
+        }
+    }
+    for _, operation := range partition.Operations {
+        for _, e := range operation.DstExtents {
+            mark(e)
+        }
+    }
+    mark(partition.GetHashTreeExtent())
+    mark(partition.GetFecExtent())
+    return covered
+}
+
+// fillValue reports whether block consists of a single repeated 32-bit value.
+func fillValue(block []byte) (uint32, bool) {
+    for i := 4; i < len(block); i += 4 {
+        if !bytes.Equal(block[i:i+4], block[:4]) {
+            return 0, false
+        }
+    }
+    return binary.LittleEndian.Uint32(block), true
+}
+
+// sparseChunks splits the image in r into chunks. Blocks that are not
+// covered become DONT_CARE, uniform blocks FILL and everything else RAW.
+func sparseChunks(r io.ReaderAt, totalBlocks uint64, covered []bool) ([]sparseChunk, error) {
+    var chunks []sparseChunk
+    block := make([]byte, blockSize)
+    for b := uint64(0); b < totalBlocks; b++ {
+        chunk := sparseChunk{chunkType: sparseChunkDontCare, start: uint32(b), blocks: 1}
+        if covered[b] {
+            n, err := r.ReadAt(block, int64(b*blockSize))
+            if err != nil && err != io.EOF {
+                return nil, err
+            }
+            for i := n; i < len(block); i++ {
+                block[i] = 0
+            }
+            if value, ok := fillValue(block); ok {
+                chunk.chunkType = sparseChunkFill
+                chunk.fill = value
+            } else {
+                chunk.chunkType = sparseChunkRaw
+            }
+        }
+
+        if len(chunks) > 0 {
+            last := &chunks[len(chunks)-1]
+            if last.chunkType == chunk.chunkType && last.fill == chunk.fill &&
+                (chunk.chunkType != sparseChunkRaw || last.blocks < sparseMaxRawBlocks) {
+                last.blocks++
+                continue
+            }
+        }
+        chunks = append(chunks, chunk)
+    }
+    return chunks, nil
+}
+
+// writeSparseImage converts the raw image of partition in r to an Android
+// sparse image written to w.
+func writeSparseImage(w io.Writer, r io.ReaderAt, partition *chromeos_update_engine.PartitionUpdate) error {
+    size := partition.GetNewPartitionInfo().GetSize()
+    totalBlocks := (size + blockSize - 1) / blockSize
+    chunks, err := sparseChunks(r, totalBlocks, partitionCoverage(partition, totalBlocks))
+    if err != nil {
+        return err
+    }
+
+    bw := bufio.NewWriter(w)
+    header := make([]byte, sparseHeaderSize)
+    binary.LittleEndian.PutUint32(header[0:], sparseHeaderMagic)
+    binary.LittleEndian.PutUint16(header[4:], 1)
+    binary.LittleEndian.PutUint16(header[6:], 0)
+    binary.LittleEndian.PutUint16(header[8:], sparseHeaderSize)
+    binary.LittleEndian.PutUint16(header[10:], sparseChunkSize)
+    binary.LittleEndian.PutUint32(header[12:], blockSize)
+    binary.LittleEndian.PutUint32(header[16:], uint32(totalBlocks))
+    binary.LittleEndian.PutUint32(header[20:], uint32(len(chunks)))
+    if _, err := bw.Write(header); err != nil {
+        return err
+    }
+
+    chunkHeader := make([]byte, sparseChunkSize)
+    for _, chunk := range chunks {
+        var body []byte
+        switch chunk.chunkType {
+        case sparseChunkFill:
+            body = make([]byte, 4)
+            binary.LittleEndian.PutUint32(body, chunk.fill)
+        case sparseChunkRaw:
+            body = make([]byte, uint64(chunk.blocks)*blockSize)
+            n, err := r.ReadAt(body, int64(chunk.start)*blockSize)
+            if err != nil && err != io.EOF {
+                return err
+            }
+            for i := n; i < len(body); i++ {
+                body[i] = 0
+            }
+        }
+
+        binary.LittleEndian.PutUint16(chunkHeader[0:], chunk.chunkType)
+        binary.LittleEndian.PutUint16(chunkHeader[2:], 0)
+        binary.LittleEndian.PutUint32(chunkHeader[4:], chunk.blocks)
+        binary.LittleEndian.PutUint32(chunkHeader[8:], uint32(sparseChunkSize+len(body)))
+        if _, err := bw.Write(chunkHeader); err != nil {
+            return err
+        }
+        if _, err := bw.Write(body); err != nil {
+            return err
+        }
+    }
+    return bw.Flush()
+}
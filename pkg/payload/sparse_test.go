@@ -0,0 +1,109 @@
+package payload
+
+import (
+    "bytes"
+    "encoding/binary"
+    "testing"
+
+    "google.golang.org/protobuf/proto"
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+func TestWriteSparseImage(t *testing.T) {
+    // More RAW blocks than fit in one chunk, two uncovered blocks, a ZERO
+    // operation, a uniform block and a final uncovered block.
+    rawBlocks := uint64(sparseMaxRawBlocks + 2)
+    totalBlocks := rawBlocks + 2 + 4 + 1 + 1
+    operation := func(opType chromeos_update_engine.InstallOperation_Type, start, blocks uint64) *chromeos_update_engine.InstallOperation {
+        return &chromeos_update_engine.InstallOperation{
+            Type: opType.Enum(),
+            DstExtents: []*chromeos_update_engine.Extent{testExtent(start, blocks)},
+        }
+    }
+    partition := &chromeos_update_engine.PartitionUpdate{
+        PartitionName: proto.String("system"),
+        NewPartitionInfo: &chromeos_update_engine.PartitionInfo{Size: proto.Uint64(totalBlocks * blockSize)},
+        Operations: []*chromeos_update_engine.InstallOperation{
+            operation(chromeos_update_engine.InstallOperation_REPLACE, 0, rawBlocks),
+            operation(chromeos_update_engine.InstallOperation_ZERO, rawBlocks+2, 4),
+            operation(chromeos_update_engine.InstallOperation_REPLACE, rawBlocks+6, 1),
+        },
+    }
+
+    img := make(memImage, totalBlocks*blockSize)
+    for i := range img {
+        img[i] = byte(i*7 + i>>12)
+    }
+    // Uncovered blocks hold stale data that must not be written.
+    for i := rawBlocks * blockSize; i < (rawBlocks+2)*blockSize; i++ {
+        img[i] = 0x77
+    }
+    for i := (rawBlocks + 2) * blockSize; i < (rawBlocks+6)*blockSize; i++ {
+        img[i] = 0
+    }
+    for i := (rawBlocks + 6) * blockSize; i < (rawBlocks+7)*blockSize; i++ {
+        img[i] = 0xAB
+    }
+
+    var out bytes.Buffer
+    if err := writeSparseImage(&out, img, partition); err != nil {
+        t.Fatal(err)
+    }
+    simg := out.Bytes()
+
+    le := binary.LittleEndian
+    if magic := le.Uint32(simg); magic != 0xed26ff3a {
+        t.Fatalf("magic %#x", magic)
+    }
+    if major, minor, headerSize, chunkHeaderSize, blkSize := le.Uint16(simg[4:]), le.Uint16(simg[6:]), le.Uint16(simg[8:]), le.Uint16(simg[10:]), le.Uint32(simg[12:]); major != 1 || minor != 0 || headerSize != 28 || chunkHeaderSize != 12 || blkSize != blockSize {
+        t.Fatalf("version %d.%d, header sizes %d and %d, block size %d", major, minor, headerSize, chunkHeaderSize, blkSize)
+    }
+
+    want := []struct {
+        chunkType uint16
+        blocks    uint32
+        fill      uint32
+    }{
+        {0xcac1, sparseMaxRawBlocks, 0},
+        {0xcac1, 2, 0},
+        {0xcac3, 2, 0},
+        {0xcac2, 4, 0},
+        {0xcac2, 1, 0xABABABAB},
+        {0xcac3, 1, 0},
+    }
+    if totalBlks, totalChunks := le.Uint32(simg[16:]), le.Uint32(simg[20:]); totalBlks != uint32(totalBlocks) || totalChunks != uint32(len(want)) {
+        t.Fatalf("header has %d blocks in %d chunks, want %d in %d", totalBlks, totalChunks, totalBlocks, len(want))
+    }
+
+    pos := 28
+    block := uint64(0)
+    for i, w := range want {
+        if len(simg) < pos+12 {
+            t.Fatalf("chunk %d: image ends at %d", i, len(simg))
+        }
+        chunkType, blocks, size := le.Uint16(simg[pos:]), le.Uint32(simg[pos+4:]), le.Uint32(simg[pos+8:])
+        body := simg[pos+12 : pos+int(size)]
+        if chunkType != w.chunkType || blocks != w.blocks {
+            t.Fatalf("chunk %d: type %#x of %d blocks, want %#x of %d", i, chunkType, blocks, w.chunkType, w.blocks)
+        }
+        switch chunkType {
+        case 0xcac1:
+            if !bytes.Equal(body, img[block*blockSize:(block+uint64(blocks))*blockSize]) {
+                t.Errorf("chunk %d: RAW data differs from the image", i)
+            }
+        case 0xcac2:
+            if len(body) != 4 || le.Uint32(body) != w.fill {
+                t.Errorf("chunk %d: fill %x, want %08x", i, body, w.fill)
+            }
+        case 0xcac3:
+            if len(body) != 0 {
+                t.Errorf("chunk %d: DONT_CARE with %d bytes of data", i, len(body))
+            }
+        }
+        pos += int(size)
+        block += uint64(blocks)
+    }
+    if pos != len(simg) {
+        t.Errorf("%d bytes after the last chunk", len(simg)-pos)
+    }
+}
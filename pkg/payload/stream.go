@@ -0,0 +1,173 @@
+package payload
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "sort"
+    "time"
+
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+const (
+    // Manifests of full OTAs are a few megabytes at most, and metadata
+    // signatures a few kilobytes.
+    maxStreamManifestSize  = 64 << 20
+    maxStreamSignatureSize = 1 << 20
+)
+
+// ErrStreamUnsupported is returned by the operations that read the data of
+// the payload, which a streamed payload does not keep.
+var ErrStreamUnsupported = errors.New("Not supported for streamed payloads")
+
+// NewPayloadFromStream returns a payload that is read from r in a single
+// forward pass, such as stdin or a pipe. Only extraction is supported, as the
+// data of the payload can not be read back.
+func NewPayloadFromStream(r io.Reader) *Payload {
+    return &Payload{
+        stream:      r,
+        concurrency: 4,
+    }
+}
+
+// openStream reads the metadata of the payload, up to and including the
+// metadata signature, from the stream into memory.
+func (p *Payload) openStream() error {
+    header := make([]byte, 24)
+    if _, err := io.ReadFull(p.stream, header); err != nil {
+        return err
+    }
+    if string(header[:4]) != payloadHeaderMagic {
+        return fmt.Errorf("Invalid payload magic: %s", header[:4])
+    }
+    if version := binary.BigEndian.Uint64(header[4:]); version != brilloMajorPayloadVersion {
+        return fmt.Errorf("Unsupported payload version: %d", version)
+    }
+    manifestLen := binary.BigEndian.Uint64(header[12:])
+    metadataSignatureLen := binary.BigEndian.Uint32(header[20:])
+    // The metadata is held in memory, so a corrupt header must not make it
+    // buffer the whole stream.
+    if manifestLen > maxStreamManifestSize || metadataSignatureLen > maxStreamSignatureSize {
+        return fmt.Errorf("Payload metadata too large: %d byte manifest, %d byte signature", manifestLen, metadataSignatureLen)
+    }
+
+    metadata := bytes.NewBuffer(header)
+    n, err := io.CopyN(metadata, p.stream, int64(manifestLen)+int64(metadataSignatureLen))
+    if err != nil {
+        return fmt.Errorf("Failed to read payload metadata: %d bytes read (%w)", n, err)
+    }
+    p.reader = io.NewSectionReader(bytes.NewReader(metadata.Bytes()), 0, int64(metadata.Len()))
+    return nil
+}
+
+type streamOperation struct {
+    writer    *partitionWriter
+    index     int
+    operation *chromeos_update_engine.InstallOperation
+}
+
+// extractStream extracts partitions while reading the payload data once,
+// front to back. Operations are applied in the order of their data. A result
+// is recorded for every partition, an error that stops the stream fails all
+// partitions that are not finished yet. Once ctx is done, reading stops and
+// the partial images are removed.
+func (p *Payload) extractStream(ctx context.Context, targetDirectory string, partitions []*chromeos_update_engine.PartitionUpdate) (err error) {
+    start := time.Now()
+    stream := &contextReader{ctx, p.stream}
+    var writers []*partitionWriter
+    finished := make(map[*chromeos_update_engine.PartitionUpdate]bool)
+    defer func() {
+        for _, w := range writers {
+            w.close()
+            if w.out != nil {
+                p.closeImage(targetDirectory, w.partition, w.out, false)
+                if ctx.Err() != nil {
+                    p.discardImage(w.out)
+                }
+            }
+        }
+        for _, partition := range partitions {
+            if !finished[partition] {
+                p.recordResult(partition, start, HashUnavailable, err)
+            }
+        }
+    }()
+
+    var operations []streamOperation
+    for _, partition := range partitions {
+        file, err := p.createImage(targetDirectory, partition)
+        if err != nil {
+            return err
+        }
+        w := newPartitionWriter(ctx, p, partition, file, true)
+        writers = append(writers, w)
+
+        p.progressStart(partition)
+        for i, operation := range partition.Operations {
+            operations = append(operations, streamOperation{w, i, operation})
+        }
+    }
+
+    // Operations without data go first, the rest follow the stream.
+    sort.SliceStable(operations, func(i, j int) bool {
+        a, b := operations[i].operation, operations[j].operation
+        if (a.GetDataLength() == 0) != (b.GetDataLength() == 0) {
+            return a.GetDataLength() == 0
+        }
+        return a.GetDataOffset() < b.GetDataOffset()
+    })
+
+    // A failed operation fails its partition only, the data of its remaining
+    // operations is skipped.
+    failed := make(map[*partitionWriter]error)
+    offset := uint64(0)
+    for _, op := range operations {
+        dataOffset, dataLength := op.operation.GetDataOffset(), op.operation.GetDataLength()
+        if dataLength > 0 {
+            if dataOffset < offset {
+                return fmt.Errorf("Operation data overlaps, can not be streamed: %s #%d", op.writer.partition.GetPartitionName(), op.index)
+            }
+            if _, err := io.CopyN(io.Discard, stream, int64(dataOffset-offset)); err != nil {
+                return err
+            }
+            offset = dataOffset + dataLength
+        }
+
+        blob := io.LimitReader(stream, int64(dataLength))
+        if failed[op.writer] == nil {
+            if err := op.writer.apply(op.index, op.operation, blob); err != nil {
+                failed[op.writer] = err
+            }
+        }
+        // Skip whatever the operation did not consume, to stay in step.
+        if _, err := io.Copy(io.Discard, blob); err != nil {
+            return err
+        }
+        p.progressIncrement(op.writer.partition)
+    }
+
+    var firstErr error
+    for _, w := range writers {
+        status, err := HashUnavailable, failed[w]
+        if err == nil {
+            status, err = w.finish()
+        }
+        if closeErr := p.closeImage(targetDirectory, w.partition, w.out, err == nil); err == nil {
+            err = closeErr
+        }
+        if err != nil && ctx.Err() != nil {
+            p.discardImage(w.out)
+        }
+        w.out = nil
+        p.recordResult(w.partition, start, status, err)
+        finished[w.partition] = true
+        if err != nil && firstErr == nil {
+            firstErr = err
+        }
+    }
+    return firstErr
+}
@@ -0,0 +1,76 @@
+package payload
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+func TestExtractStream(t *testing.T) {
+    image := bytes.Repeat([]byte("stream"), 4*blockSize/6+1)[:4*blockSize]
+    p := NewPayloadFromStream(bytes.NewReader(testPayload(t, image)))
+    if err := p.Open(); err != nil {
+        t.Fatal(err)
+    }
+    if err := p.Init(); err != nil {
+        t.Fatal(err)
+    }
+    dir := t.TempDir()
+    if err := p.ExtractAll(dir); err != nil {
+        t.Fatal(err)
+    }
+    got, err := os.ReadFile(filepath.Join(dir, "system.img"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !bytes.Equal(got, image) {
+        t.Fatal("extracted image differs from the payload")
+    }
+}
+
+func TestOpenStreamInvalidHeader(t *testing.T) {
+    valid := testPayload(t, make([]byte, blockSize))
+    tests := []struct {
+        name  string
+        patch func(header []byte)
+        err   string
+    }{
+        {"magic", func(h []byte) { copy(h, "PK\x03\x04") }, "Invalid payload magic"},
+        {"version", func(h []byte) { binary.BigEndian.PutUint64(h[4:], 1) }, "Unsupported payload version: 1"},
+        {"manifest size", func(h []byte) { binary.BigEndian.PutUint64(h[12:], 1<<40) }, "Payload metadata too large"},
+        {"signature size", func(h []byte) { binary.BigEndian.PutUint32(h[20:], 1<<31) }, "Payload metadata too large"},
+    }
+    for _, test := range tests {
+        data := append([]byte(nil), valid...)
+        test.patch(data)
+        r := bytes.NewReader(data)
+        err := NewPayloadFromStream(r).Open()
+        if err == nil || !strings.Contains(err.Error(), test.err) {
+            t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+        }
+        // Nothing past the header is read.
+        if read := len(data) - r.Len(); read != 24 {
+            t.Errorf("%s: read %d bytes, want 24", test.name, read)
+        }
+    }
+}
+
+func TestStreamVerifyUnsupported(t *testing.T) {
+    p := NewPayloadFromStream(bytes.NewReader(testPayload(t, make([]byte, blockSize))))
+    if err := p.Open(); err != nil {
+        t.Fatal(err)
+    }
+    if err := p.Init(); err != nil {
+        t.Fatal(err)
+    }
+    if _, err := p.VerifyPayload(); !errors.Is(err, ErrStreamUnsupported) {
+        t.Errorf("VerifyPayload: got %v, want ErrStreamUnsupported", err)
+    }
+    if err := p.VerifyPayloadSignature(nil); !errors.Is(err, ErrStreamUnsupported) {
+        t.Errorf("VerifyPayloadSignature: got %v, want ErrStreamUnsupported", err)
+    }
+}
@@ -0,0 +1,315 @@
+package payload
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+)
+
+// Logical partition metadata (liblp) format, version 10.0.
+const (
+    lpGeometryMagic      = 0x616c4467
+    lpGeometrySize       = 4096
+    lpHeaderMagic        = 0x414c5030
+    lpMajorVersion       = 10
+    lpMinorVersion       = 0
+    lpReservedBytes      = 4096
+    lpSectorSize         = 512
+    lpMetadataMaxSize    = 65536
+    lpMetadataSlotCount  = 2
+    lpAlignment          = 1 << 20
+    lpPartitionReadonly  = 1 << 0
+    lpTargetTypeLinear   = 0
+    lpSuperPartitionName = "super"
+    lpDefaultGroupName   = "default"
+)
+
+type lpGeometry struct {
+    Magic             uint32
+    StructSize        uint32
+    Checksum          [32]byte
+    MetadataMaxSize   uint32
+    MetadataSlotCount uint32
+    LogicalBlockSize  uint32
+}
+
+type lpTableDescriptor struct {
+    Offset     uint32
+    NumEntries uint32
+    EntrySize  uint32
+}
+
+type lpHeader struct {
+    Magic          uint32
+    MajorVersion   uint16
+    MinorVersion   uint16
+    HeaderSize     uint32
+    HeaderChecksum [32]byte
+    TablesSize     uint32
+    TablesChecksum [32]byte
+    Partitions     lpTableDescriptor
+    Extents        lpTableDescriptor
+    Groups         lpTableDescriptor
+    BlockDevices   lpTableDescriptor
+}
+
+type lpPartition struct {
+    Name             [36]byte
+    Attributes       uint32
+    FirstExtentIndex uint32
+    NumExtents       uint32
+    GroupIndex       uint32
+}
+
+type lpExtent struct {
+    NumSectors   uint64
+    TargetType   uint32
+    TargetData   uint64
+    TargetSource uint32
+}
+
+type lpGroup struct {
+    Name        [36]byte
+    Flags       uint32
+    MaximumSize uint64
+}
+
+type lpBlockDevice struct {
+    FirstLogicalSector uint64
+    Alignment          uint32
+    AlignmentOffset    uint32
+    Size               uint64
+    PartitionName      [36]byte
+    Flags              uint32
+}
+
+func lpName(name string) ([36]byte, error) {
+    var b [36]byte
+    if len(name) >= len(b) {
+        return b, fmt.Errorf("Name too long for logical partition metadata: %s", name)
+    }
+    copy(b[:], name)
+    return b, nil
+}
+
+func alignUp(n, alignment uint64) uint64 {
+    return (n + alignment - 1) / alignment * alignment
+}
+
+// marshalLE encodes the packed little-endian form of every value in v.
+func marshalLE(v ...interface{}) []byte {
+    var buf bytes.Buffer
+    for _, x := range v {
+        binary.Write(&buf, binary.LittleEndian, x)
+    }
+    return buf.Bytes()
+}
+
+// copyAt copies src to dst at offset. All-zero chunks are skipped, so they
+// stay holes in a freshly created dst.
+func copyAt(dst io.WriterAt, offset int64, src io.Reader) (int64, error) {
+    buf := make([]byte, 1<<20)
+    zero := make([]byte, len(buf))
+    written := int64(0)
+    for {
+        n, err := io.ReadFull(src, buf)
+        if n > 0 && !bytes.Equal(buf[:n], zero[:n]) {
+            if _, err := dst.WriteAt(buf[:n], offset+written); err != nil {
+                return written, err
+            }
+        }
+        written += int64(n)
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            return written, nil
+        }
+        if err != nil {
+            return written, err
+        }
+    }
+}
+
+// superPartition is a logical partition placed in the super image.
+type superPartition struct {
+    name   string
+    image  string
+    size   uint64
+    offset uint64
+}
+
+// BuildSuperImage assembles the extracted images of the dynamic partitions in
+// targetDirectory into targetDirectory/super.img. The partitions are placed in
+// slot _a, slot _b gets the same groups with empty partitions, like the
+// super.img of a factory image. Without Virtual A/B (snapshot_enabled unset)
+// the image is sized for the groups of both slots so that slot _b can be
+// updated in place, with Virtual A/B one slot's worth of groups is enough.
+func (p *Payload) BuildSuperImage(targetDirectory string) error {
+    if !p.initialized {
+        return errors.New("Payload has not been initialized")
+    }
+    if p.sparseOutput {
+        return errors.New("super.img can only be built from raw images")
+    }
+    metadata := p.deltaArchiveManifest.GetDynamicPartitionMetadata()
+    if len(metadata.GetGroups()) == 0 {
+        return errors.New("Payload has no dynamic partition metadata")
+    }
+
+    sizes := make(map[string]uint64)
+    for _, partition := range p.deltaArchiveManifest.Partitions {
+        sizes[partition.GetPartitionName()] = partition.GetNewPartitionInfo().GetSize()
+    }
+
+    metadataBytes := uint64(lpReservedBytes + 2*lpGeometrySize + 2*lpMetadataMaxSize*lpMetadataSlotCount)
+    firstLogicalByte := alignUp(metadataBytes, lpAlignment)
+
+    // Lay out the partitions of slot _a one after another, each aligned.
+    groups := []lpGroup{{}}
+    groups[0].Name, _ = lpName(lpDefaultGroupName)
+    var partitions []lpPartition
+    var extents []lpExtent
+    var members []superPartition
+    offset := firstLogicalByte
+    groupsSize := uint64(0)
+    for _, slot := range []string{"_a", "_b"} {
+        for _, group := range metadata.GetGroups() {
+            name, err := lpName(group.GetName() + slot)
+            if err != nil {
+                return err
+            }
+            groups = append(groups, lpGroup{Name: name, MaximumSize: group.GetSize()})
+            groupIndex := uint32(len(groups) - 1)
+            groupUsed := uint64(0)
+            if slot == "_a" || !metadata.GetSnapshotEnabled() {
+                groupsSize += group.GetSize()
+            }
+
+            for _, partitionName := range group.GetPartitionNames() {
+                size, ok := sizes[partitionName]
+                if !ok {
+                    return fmt.Errorf("Dynamic partition not found in payload: %s", partitionName)
+                }
+                name, err := lpName(partitionName + slot)
+                if err != nil {
+                    return err
+                }
+                entry := lpPartition{
+                    Name:             name,
+                    Attributes:       lpPartitionReadonly,
+                    FirstExtentIndex: uint32(len(extents)),
+                    GroupIndex:       groupIndex,
+                }
+                if slot == "_a" && size > 0 {
+                    entry.NumExtents = 1
+                    extents = append(extents, lpExtent{
+                        NumSectors: size / lpSectorSize,
+                        TargetType: lpTargetTypeLinear,
+                        TargetData: offset / lpSectorSize,
+                    })
+                    members = append(members, superPartition{
+                        name:   partitionName,
+                        image:  filepath.Join(targetDirectory, fmt.Sprintf("%s.img", partitionName)),
+                        size:   size,
+                        offset: offset,
+                    })
+                    offset = alignUp(offset+size, lpAlignment)
+                    groupUsed += size
+                }
+                partitions = append(partitions, entry)
+            }
+            if group.GetSize() > 0 && groupUsed > group.GetSize() {
+                return fmt.Errorf("Partitions exceed the size of group %s: %d > %d", group.GetName(), groupUsed, group.GetSize())
+            }
+        }
+    }
+
+    superSize := alignUp(firstLogicalByte+groupsSize, lpAlignment)
+    if offset > superSize {
+        superSize = offset
+    }
+    superName, _ := lpName(lpSuperPartitionName)
+    blockDevices := []lpBlockDevice{{
+        FirstLogicalSector: firstLogicalByte / lpSectorSize,
+        Alignment:          lpAlignment,
+        Size:               superSize,
+        PartitionName:      superName,
+    }}
+
+    // Tables are stored in the order partitions, extents, groups, block
+    // devices.
+    partitionsTable := marshalLE(partitions)
+    extentsTable := marshalLE(extents)
+    groupsTable := marshalLE(groups)
+    blockDevicesTable := marshalLE(blockDevices)
+    tables := bytes.Join([][]byte{partitionsTable, extentsTable, groupsTable, blockDevicesTable}, nil)
+
+    header := lpHeader{
+        Magic:          lpHeaderMagic,
+        MajorVersion:   lpMajorVersion,
+        MinorVersion:   lpMinorVersion,
+        TablesSize:     uint32(len(tables)),
+        TablesChecksum: sha256.Sum256(tables),
+        Partitions:     lpTableDescriptor{0, uint32(len(partitions)), uint32(binary.Size(lpPartition{}))},
+        Extents:        lpTableDescriptor{uint32(len(partitionsTable)), uint32(len(extents)), uint32(binary.Size(lpExtent{}))},
+        Groups:         lpTableDescriptor{uint32(len(partitionsTable) + len(extentsTable)), uint32(len(groups)), uint32(binary.Size(lpGroup{}))},
+        BlockDevices:   lpTableDescriptor{uint32(len(partitionsTable) + len(extentsTable) + len(groupsTable)), uint32(len(blockDevices)), uint32(binary.Size(lpBlockDevice{}))},
+    }
+    header.HeaderSize = uint32(binary.Size(header))
+    header.HeaderChecksum = sha256.Sum256(marshalLE(header))
+    metadataBlob := append(marshalLE(header), tables...)
+    if len(metadataBlob) > lpMetadataMaxSize {
+        return fmt.Errorf("Logical partition metadata too large: %d > %d", len(metadataBlob), lpMetadataMaxSize)
+    }
+
+    geometry := lpGeometry{
+        Magic:             lpGeometryMagic,
+        MetadataMaxSize:   lpMetadataMaxSize,
+        MetadataSlotCount: lpMetadataSlotCount,
+        LogicalBlockSize:  blockSize,
+    }
+    geometry.StructSize = uint32(binary.Size(geometry))
+    geometry.Checksum = sha256.Sum256(marshalLE(geometry))
+    geometryBlob := marshalLE(geometry)
+
+    out, err := os.OpenFile(filepath.Join(targetDirectory, "super.img"), os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0o755)
+    if err != nil {
+        return err
+    }
+    defer out.Close()
+
+    // Reserved bytes, primary and backup geometry, then the primary and
+    // backup metadata, one copy per slot.
+    writes := map[int64][]byte{
+        lpReservedBytes:                  geometryBlob,
+        lpReservedBytes + lpGeometrySize: geometryBlob,
+    }
+    metadataOffset := int64(lpReservedBytes + 2*lpGeometrySize)
+    for i := int64(0); i < 2*lpMetadataSlotCount; i++ {
+        writes[metadataOffset+i*lpMetadataMaxSize] = metadataBlob
+    }
+    for offset, data := range writes {
+        if _, err := out.WriteAt(data, offset); err != nil {
+            return err
+        }
+    }
+
+    for _, member := range members {
+        image, err := os.Open(member.image)
+        if err != nil {
+            return err
+        }
+        n, err := copyAt(out, int64(member.offset), io.LimitReader(image, int64(member.size)))
+        image.Close()
+        if err != nil {
+            return err
+        }
+        if uint64(n) != member.size {
+            return fmt.Errorf("Image size mismatch: %s (%d != %d)", member.name, n, member.size)
+        }
+    }
+    return out.Truncate(int64(superSize))
+}
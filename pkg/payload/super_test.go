@@ -0,0 +1,240 @@
+package payload
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/binary"
+    "os"
+    "path/filepath"
+    "testing"
+
+    "google.golang.org/protobuf/proto"
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// lpString returns the NUL-terminated name at the start of b.
+func lpString(b []byte) string {
+    if i := bytes.IndexByte(b, 0); i >= 0 {
+        return string(b[:i])
+    }
+    return string(b)
+}
+
+// lpChecksum returns the sha256 of b with the 32-byte checksum at offset
+// zeroed, the way liblp computes the geometry and header checksums.
+func lpChecksum(b []byte, offset int) []byte {
+    b = append([]byte(nil), b...)
+    copy(b[offset:offset+32], make([]byte, 32))
+    hash := sha256.Sum256(b)
+    return hash[:]
+}
+
+// TestBuildSuperImage parses super.img back with the field offsets of liblp's
+// metadata_format.h, version 10.0, rather than with the structs that wrote it.
+func TestBuildSuperImage(t *testing.T) {
+    le := binary.LittleEndian
+    dir := t.TempDir()
+    images := map[string][]byte{
+        "system": bytes.Repeat([]byte("system"), (1<<20+blockSize)/6+1)[:1<<20+blockSize],
+        "vendor": bytes.Repeat([]byte("vendor"), 2*blockSize/6+1)[:2*blockSize],
+    }
+    var partitions []*chromeos_update_engine.PartitionUpdate
+    for _, name := range []string{"system", "vendor"} {
+        if err := os.WriteFile(filepath.Join(dir, name+".img"), images[name], 0o644); err != nil {
+            t.Fatal(err)
+        }
+        partitions = append(partitions, &chromeos_update_engine.PartitionUpdate{
+            PartitionName: proto.String(name),
+            NewPartitionInfo: &chromeos_update_engine.PartitionInfo{Size: proto.Uint64(uint64(len(images[name])))},
+        })
+    }
+    p := &Payload{
+        initialized: true,
+        deltaArchiveManifest: &chromeos_update_engine.DeltaArchiveManifest{
+            Partitions: partitions,
+            DynamicPartitionMetadata: &chromeos_update_engine.DynamicPartitionMetadata{
+                Groups: []*chromeos_update_engine.DynamicPartitionGroup{{
+                    Name: proto.String("main"),
+                    Size: proto.Uint64(8 << 20),
+                    PartitionNames: []string{"system", "vendor"},
+                }},
+                SnapshotEnabled: proto.Bool(true),
+            },
+        },
+    }
+    if err := p.BuildSuperImage(dir); err != nil {
+        t.Fatal(err)
+    }
+    super, err := os.ReadFile(filepath.Join(dir, "super.img"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 1 MiB of metadata, then the 8 MiB group of one slot for Virtual A/B.
+    if len(super) != 9<<20 {
+        t.Fatalf("super.img is %d bytes, want %d", len(super), 9<<20)
+    }
+
+    // Primary and backup geometry follow the 4096 reserved bytes.
+    geometry := super[4096 : 4096+52]
+    if !bytes.Equal(super[8192:8192+52], geometry) {
+        t.Error("backup geometry differs from the primary")
+    }
+    if magic := le.Uint32(geometry); magic != 0x616c4467 {
+        t.Errorf("geometry magic %#x", magic)
+    }
+    if size := le.Uint32(geometry[4:]); size != 52 {
+        t.Errorf("geometry struct size %d, want 52", size)
+    }
+    if !bytes.Equal(geometry[8:40], lpChecksum(geometry, 8)) {
+        t.Error("geometry checksum mismatch")
+    }
+    if maxSize, slots, block := le.Uint32(geometry[40:]), le.Uint32(geometry[44:]), le.Uint32(geometry[48:]); maxSize != 65536 || slots != 2 || block != 4096 {
+        t.Errorf("geometry has metadata max size %d, %d slots, block size %d", maxSize, slots, block)
+    }
+
+    // Primary metadata for both slots, then the backups.
+    metadata := super[12288 : 12288+65536]
+    for i := 1; i < 4; i++ {
+        if !bytes.Equal(super[12288+i*65536:12288+(i+1)*65536], metadata) {
+            t.Errorf("metadata copy %d differs from the first", i)
+        }
+    }
+    header := metadata[:128]
+    if magic := le.Uint32(header); magic != 0x414c5030 {
+        t.Errorf("header magic %#x", magic)
+    }
+    if major, minor, size := le.Uint16(header[4:]), le.Uint16(header[6:]), le.Uint32(header[8:]); major != 10 || minor != 0 || size != 128 {
+        t.Errorf("header version %d.%d, size %d", major, minor, size)
+    }
+    if !bytes.Equal(header[12:44], lpChecksum(header, 12)) {
+        t.Error("header checksum mismatch")
+    }
+    tablesSize := le.Uint32(header[44:])
+    tables := metadata[128 : 128+tablesSize]
+    if hash := sha256.Sum256(tables); !bytes.Equal(header[48:80], hash[:]) {
+        t.Error("tables checksum mismatch")
+    }
+
+    // Descriptors of the partitions, extents, groups and block devices.
+    descriptors := []struct {
+        name                   string
+        offset, count, entrySize uint32
+    }{
+        {"partitions", 0, 4, 52},
+        {"extents", 208, 2, 24},
+        {"groups", 256, 3, 48},
+        {"block devices", 400, 1, 64},
+    }
+    table := make([][]byte, len(descriptors))
+    for i, want := range descriptors {
+        d := header[80+12*i:]
+        offset, count, entrySize := le.Uint32(d), le.Uint32(d[4:]), le.Uint32(d[8:])
+        if offset != want.offset || count != want.count || entrySize != want.entrySize {
+            t.Fatalf("%s table at %d, %d entries of %d bytes, want %d, %d, %d", want.name, offset, count, entrySize, want.offset, want.count, want.entrySize)
+        }
+        table[i] = tables[offset : offset+count*entrySize]
+    }
+    if tablesSize != 464 {
+        t.Errorf("tables size %d, want 464", tablesSize)
+    }
+
+    groups := table[2]
+    for i, want := range []struct {
+        name    string
+        maxSize uint64
+    }{{"default", 0}, {"main_a", 8 << 20}, {"main_b", 8 << 20}} {
+        g := groups[48*i:]
+        if name, maxSize := lpString(g[:36]), le.Uint64(g[40:]); name != want.name || maxSize != want.maxSize {
+            t.Errorf("group %d is %s of %d bytes, want %s of %d", i, name, maxSize, want.name, want.maxSize)
+        }
+    }
+
+    device := table[3]
+    if first, alignment, size, name := le.Uint64(device), le.Uint32(device[8:]), le.Uint64(device[16:]), lpString(device[24:60]); first != 2048 || alignment != 1<<20 || size != 9<<20 || name != "super" {
+        t.Errorf("block device %s at sector %d, alignment %d, size %d", name, first, alignment, size)
+    }
+
+    // Slot _a partitions are placed at 1 MiB boundaries, slot _b ones are
+    // empty.
+    for i, want := range []struct {
+        name       string
+        extents    uint32
+        group      uint32
+        image      string
+        offset     int
+    }{
+        {"system_a", 1, 1, "system", 1 << 20},
+        {"vendor_a", 1, 1, "vendor", 3 << 20},
+        {"system_b", 0, 2, "", 0},
+        {"vendor_b", 0, 2, "", 0},
+    } {
+        entry := table[0][52*i:]
+        name, attributes := lpString(entry[:36]), le.Uint32(entry[36:])
+        firstExtent, numExtents, group := le.Uint32(entry[40:]), le.Uint32(entry[44:]), le.Uint32(entry[48:])
+        if name != want.name || attributes != 1 || numExtents != want.extents || group != want.group {
+            t.Errorf("partition %d is %s with attributes %d, %d extents, group %d", i, name, attributes, numExtents, group)
+            continue
+        }
+        if numExtents == 0 {
+            continue
+        }
+        extent := table[1][24*firstExtent:]
+        sectors, targetType, targetData, targetSource := le.Uint64(extent), le.Uint32(extent[8:]), le.Uint64(extent[12:]), le.Uint32(extent[20:])
+        image := images[want.image]
+        if sectors*512 != uint64(len(image)) || targetType != 0 || targetData*512 != uint64(want.offset) || targetSource != 0 {
+            t.Errorf("%s: extent of %d sectors at sector %d, type %d, source %d", name, sectors, targetData, targetType, targetSource)
+            continue
+        }
+        if !bytes.Equal(super[want.offset:want.offset+len(image)], image) {
+            t.Errorf("%s: data at %d differs from %s.img", name, want.offset, want.image)
+        }
+    }
+}
+
+// TestBuildSuperImageBothSlots checks that without Virtual A/B super.img has
+// room for the groups of both slots.
+func TestBuildSuperImageBothSlots(t *testing.T) {
+    dir := t.TempDir()
+    image := bytes.Repeat([]byte{0x5A}, 2*blockSize)
+    if err := os.WriteFile(filepath.Join(dir, "system.img"), image, 0o644); err != nil {
+        t.Fatal(err)
+    }
+    p := &Payload{
+        initialized: true,
+        deltaArchiveManifest: &chromeos_update_engine.DeltaArchiveManifest{
+            Partitions: []*chromeos_update_engine.PartitionUpdate{{
+                PartitionName: proto.String("system"),
+                NewPartitionInfo: &chromeos_update_engine.PartitionInfo{Size: proto.Uint64(uint64(len(image)))},
+            }},
+            DynamicPartitionMetadata: &chromeos_update_engine.DynamicPartitionMetadata{
+                Groups: []*chromeos_update_engine.DynamicPartitionGroup{{
+                    Name: proto.String("main"),
+                    Size: proto.Uint64(8 << 20),
+                    PartitionNames: []string{"system"},
+                }},
+            },
+        },
+    }
+    if err := p.BuildSuperImage(dir); err != nil {
+        t.Fatal(err)
+    }
+    super, err := os.ReadFile(filepath.Join(dir, "super.img"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    // 1 MiB of metadata, then the 8 MiB groups of slots _a and _b.
+    if len(super) != 17<<20 {
+        t.Fatalf("super.img is %d bytes, want %d", len(super), 17<<20)
+    }
+
+    le := binary.LittleEndian
+    header := super[12288 : 12288+128]
+    devices := le.Uint32(header[80+12*3:])
+    device := super[12288+128+int(devices):]
+    if size := le.Uint64(device[16:]); size != 17<<20 {
+        t.Errorf("block device size %d, want %d", size, 17<<20)
+    }
+    if !bytes.Equal(super[1<<20:1<<20+len(image)], image) {
+        t.Error("system_a data differs from system.img")
+    }
+}
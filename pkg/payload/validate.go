@@ -0,0 +1,169 @@
+package payload
+
+import (
+    "errors"
+    "fmt"
+    "sort"
+
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// PayloadIssue is a single structural problem found in a payload.
+type PayloadIssue struct {
+    // Partition is empty for problems that concern the payload as a whole.
+    Partition string
+    // Operation is the index of the offending operation, or -1.
+    Operation int
+    Message   string
+}
+
+func (i PayloadIssue) String() string {
+    switch {
+    case i.Partition == "":
+        return i.Message
+    case i.Operation < 0:
+        return fmt.Sprintf("%s: %s", i.Partition, i.Message)
+    default:
+        return fmt.Sprintf("%s: operation #%d: %s", i.Partition, i.Operation, i.Message)
+    }
+}
+
+// PayloadReport lists every structural problem found by VerifyPayload.
+type PayloadReport struct {
+    Issues []PayloadIssue
+}
+
+// OK reports whether no problems were found.
+func (r *PayloadReport) OK() bool {
+    return len(r.Issues) == 0
+}
+
+func (r *PayloadReport) add(partition string, operation int, format string, args ...interface{}) {
+    r.Issues = append(r.Issues, PayloadIssue{
+        Partition: partition,
+        Operation: operation,
+        Message:   fmt.Sprintf(format, args...),
+    })
+}
+
+type dataRange struct {
+    partition string
+    operation int
+    offset    uint64
+    length    uint64
+}
+
+// VerifyPayload walks the header and the manifest and reports every
+// structural problem it finds. The returned error is only set when the
+// payload could not be inspected at all.
+func (p *Payload) VerifyPayload() (*PayloadReport, error) {
+    if !p.initialized {
+        return nil, errors.New("Payload has not been initialized")
+    }
+    if p.stream != nil {
+        return nil, fmt.Errorf("Payload verification: %w", ErrStreamUnsupported)
+    }
+
+    report := &PayloadReport{}
+
+    buf := make([]byte, len(payloadHeaderMagic))
+    if _, err := p.reader.ReadAt(buf, 0); err != nil {
+        return nil, err
+    }
+    if string(buf) != payloadHeaderMagic {
+        report.add("", -1, "Invalid magic: %q", buf)
+    }
+    if p.header.Version != brilloMajorPayloadVersion {
+        report.add("", -1, "Unsupported version: %d", p.header.Version)
+    }
+
+    size := p.reader.Size()
+    dataSize := uint64(0)
+    if size > p.dataOffset {
+        dataSize = uint64(size - p.dataOffset)
+    } else {
+        report.add("", -1, "Payload is truncated: metadata ends at %d, file size is %d", p.dataOffset, size)
+    }
+
+    manifest := p.deltaArchiveManifest
+    if manifest.GetBlockSize() != blockSize {
+        report.add("", -1, "Unsupported block size: %d", manifest.GetBlockSize())
+    }
+
+    var ranges []dataRange
+    for _, partition := range manifest.GetPartitions() {
+        name := partition.GetPartitionName()
+        if name == "" {
+            report.add("", -1, "Partition without a name")
+            name = "(unnamed)"
+        }
+
+        partitionSize := partition.GetNewPartitionInfo().GetSize()
+        if partitionSize == 0 {
+            report.add(name, -1, "Missing new partition size")
+        }
+
+        for i, operation := range partition.GetOperations() {
+            if _, ok := chromeos_update_engine.InstallOperation_Type_name[int32(operation.GetType())]; !ok {
+                report.add(name, i, "Unknown operation type: %d", operation.GetType())
+            }
+
+            if operation.DataLength != nil {
+                offset, length := operation.GetDataOffset(), operation.GetDataLength()
+                if offset+length < offset || offset+length > dataSize {
+                    report.add(name, i, "Data range [%d, %d) exceeds the payload data size %d", offset, offset+length, dataSize)
+                }
+                if length > 0 {
+                    ranges = append(ranges, dataRange{name, i, offset, length})
+                }
+            }
+
+            if partitionSize == 0 {
+                continue
+            }
+            for _, e := range operation.GetDstExtents() {
+                end := (e.GetStartBlock() + e.GetNumBlocks()) * blockSize
+                if end > partitionSize {
+                    report.add(name, i, "Destination extent [%d, +%d) exceeds the partition size %d",
+                        e.GetStartBlock(), e.GetNumBlocks(), partitionSize)
+                }
+            }
+        }
+    }
+
+    sort.SliceStable(ranges, func(i, j int) bool {
+        return ranges[i].offset < ranges[j].offset
+    })
+    // last is the range that reaches dataEnd, the one a range starting
+    // before dataEnd overlaps.
+    dataEnd := uint64(0)
+    last := -1
+    for i, r := range ranges {
+        if last >= 0 && r.offset < dataEnd {
+            prev := ranges[last]
+            report.add(r.partition, r.operation, "Data range [%d, %d) overlaps operation #%d of %s",
+                r.offset, r.offset+r.length, prev.operation, prev.partition)
+        }
+        if r.offset+r.length > dataEnd {
+            dataEnd = r.offset + r.length
+            last = i
+        }
+    }
+
+    signaturesOffset, signaturesSize := manifest.GetSignaturesOffset(), manifest.GetSignaturesSize()
+    if signaturesSize == 0 {
+        if signaturesOffset != 0 {
+            report.add("", -1, "Signatures offset %d set without a signatures size", signaturesOffset)
+        }
+    } else {
+        if signaturesOffset != dataEnd {
+            report.add("", -1, "Signatures offset mismatch: %d != %d (end of operation data)", signaturesOffset, dataEnd)
+        }
+        if signaturesOffset+signaturesSize > dataSize {
+            report.add("", -1, "Signatures range [%d, %d) exceeds the payload data size %d",
+                signaturesOffset, signaturesOffset+signaturesSize, dataSize)
+        }
+    }
+
+    return report, nil
+}
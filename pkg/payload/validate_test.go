@@ -0,0 +1,55 @@
+package payload
+
+import (
+    "bytes"
+    "io"
+    "testing"
+
+    "google.golang.org/protobuf/proto"
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+func TestVerifyPayloadOverlap(t *testing.T) {
+    data := []byte(payloadHeaderMagic + string(make([]byte, 200)))
+    operation := func(offset, length uint64) *chromeos_update_engine.InstallOperation {
+        return &chromeos_update_engine.InstallOperation{
+            Type: chromeos_update_engine.InstallOperation_REPLACE.Enum(),
+            DataOffset: proto.Uint64(offset),
+            DataLength: proto.Uint64(length),
+        }
+    }
+    p := &Payload{
+        reader: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))),
+        header: &payloadHeader{Version: brilloMajorPayloadVersion},
+        initialized: true,
+        deltaArchiveManifest: &chromeos_update_engine.DeltaArchiveManifest{
+            BlockSize: proto.Uint32(blockSize),
+            Partitions: []*chromeos_update_engine.PartitionUpdate{{
+                PartitionName: proto.String("system"),
+                NewPartitionInfo: &chromeos_update_engine.PartitionInfo{Size: proto.Uint64(blockSize)},
+                // The third range lies within the first, after the end of
+                // the second.
+                Operations: []*chromeos_update_engine.InstallOperation{
+                    operation(0, 100), operation(10, 10), operation(50, 10),
+                },
+            }},
+        },
+    }
+
+    report, err := p.VerifyPayload()
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []string{
+        "system: operation #1: Data range [10, 20) overlaps operation #0 of system",
+        "system: operation #2: Data range [50, 60) overlaps operation #0 of system",
+    }
+    if len(report.Issues) != len(want) {
+        t.Fatalf("got issues %v, want %v", report.Issues, want)
+    }
+    for i, issue := range report.Issues {
+        if issue.String() != want[i] {
+            t.Errorf("got %q, want %q", issue, want[i])
+        }
+    }
+}
@@ -0,0 +1,107 @@
+package payload
+
+import (
+    "bytes"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// hashImage returns the SHA-256 of the first size bytes of r. Bytes past the
+// end of r are hashed as zeros, the way they read back on a device.
+func hashImage(r io.ReaderAt, size int64) ([]byte, error) {
+    h := sha256.New()
+    n, err := io.Copy(h, io.NewSectionReader(r, 0, size))
+    if err != nil {
+        return nil, err
+    }
+    if _, err := io.CopyN(h, zeroReader{}, size-n); err != nil {
+        return nil, err
+    }
+    return h.Sum(nil), nil
+}
+
+// HashStatus is the outcome of a whole-partition hash check.
+type HashStatus int
+
+const (
+    // HashUnavailable means the manifest carries no hash to check against.
+    HashUnavailable HashStatus = iota
+    HashMatched
+    HashMismatched
+)
+
+func (s HashStatus) String() string {
+    switch s {
+    case HashMatched:
+        return "verified"
+    case HashMismatched:
+        return "mismatch"
+    default:
+        return "unavailable"
+    }
+}
+
+// MarshalText encodes the status by its name, as in the JSON results.
+func (s HashStatus) MarshalText() ([]byte, error) {
+    return []byte(s.String()), nil
+}
+
+// verifyPartitionHash compares the image in r against info and returns the
+// outcome along with the computed hash.
+func verifyPartitionHash(r io.ReaderAt, info *chromeos_update_engine.PartitionInfo) (HashStatus, []byte, error) {
+    if len(info.GetHash()) == 0 {
+        return HashUnavailable, nil, nil
+    }
+    hash, err := hashImage(r, int64(info.GetSize()))
+    if err != nil {
+        return HashUnavailable, nil, err
+    }
+    if !bytes.Equal(hash, info.GetHash()) {
+        return HashMismatched, hash, nil
+    }
+    return HashMatched, hash, nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+    for i := range p {
+        p[i] = 0
+    }
+    return len(p), nil
+}
+
+// verifySourceImage checks the old image of an incremental partition against
+// old_partition_info before any operation is applied to it.
+func verifySourceImage(r io.ReaderAt, partition *chromeos_update_engine.PartitionUpdate) error {
+    info := partition.GetOldPartitionInfo()
+    if len(info.GetHash()) == 0 {
+        return nil
+    }
+    hash, err := hashImage(r, int64(info.GetSize()))
+    if err != nil {
+        return err
+    }
+    if !bytes.Equal(hash, info.GetHash()) {
+        return fmt.Errorf("Verify failed (Source partition hash mismatch): %s (%s != %s)", partition.GetPartitionName(), hex.EncodeToString(hash), hex.EncodeToString(info.GetHash()))
+    }
+    return nil
+}
+
+// verifySourceData checks the source extents read for an operation against
+// its src_sha256_hash.
+func verifySourceData(data []byte, partition *chromeos_update_engine.PartitionUpdate, index int, operation *chromeos_update_engine.InstallOperation) error {
+    expected := operation.GetSrcSha256Hash()
+    if len(expected) == 0 {
+        return nil
+    }
+    hash := sha256.Sum256(data)
+    if !bytes.Equal(hash[:], expected) {
+        return fmt.Errorf("Verify failed (Source checksum mismatch): %s operation #%d %s (%s != %s)", partition.GetPartitionName(), index, operation.GetType(), hex.EncodeToString(hash[:]), hex.EncodeToString(expected))
+    }
+    return nil
+}
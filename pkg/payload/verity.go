@@ -0,0 +1,118 @@
+package payload
+
+import (
+    "bytes"
+    "crypto/sha1"
+    "crypto/sha256"
+    "fmt"
+    "hash"
+    "io"
+
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+type readerWriterAt interface {
+    io.ReaderAt
+    io.WriterAt
+}
+
+func newVerityHash(algorithm string) (func() hash.Hash, error) {
+    switch algorithm {
+    case "sha1":
+        return sha1.New, nil
+    case "sha256":
+        return sha256.New, nil
+    default:
+        return nil, fmt.Errorf("Unsupported hash tree algorithm: %q", algorithm)
+    }
+}
+
+// hashTreeLevel hashes every block of r, each prefixed with salt. Digests are
+// padded to a power of two and the level is padded to a whole block, the way
+// dm-verity expects it.
+func hashTreeLevel(r io.Reader, size uint64, newHash func() hash.Hash, salt []byte) ([]byte, error) {
+    h := newHash()
+    digestSize := h.Size()
+    paddedSize := 1
+    for paddedSize < digestSize {
+        paddedSize <<= 1
+    }
+
+    blocks := (size + blockSize - 1) / blockSize
+    level := make([]byte, 0, (blocks*uint64(paddedSize)+blockSize-1)/blockSize*blockSize)
+    block := make([]byte, blockSize)
+    for i := uint64(0); i < blocks; i++ {
+        n, err := io.ReadFull(r, block)
+        if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+            return nil, err
+        }
+        for j := n; j < len(block); j++ {
+            block[j] = 0
+        }
+
+        h.Reset()
+        h.Write(salt)
+        h.Write(block)
+        level = h.Sum(level)
+        level = append(level, make([]byte, paddedSize-digestSize)...)
+    }
+    if rem := len(level) % blockSize; rem != 0 {
+        level = append(level, make([]byte, blockSize-rem)...)
+    }
+    return level, nil
+}
+
+// buildHashTree computes the dm-verity hash tree over size bytes of r. The
+// levels are returned top-first, which is how they are stored on disk. Like
+// update_engine's HashTreeBuilder, there is always at least one level, so data
+// of a single block still gets a one-block tree.
+func buildHashTree(r io.Reader, size uint64, newHash func() hash.Hash, salt []byte) ([]byte, error) {
+    var levels [][]byte
+    for {
+        level, err := hashTreeLevel(r, size, newHash, salt)
+        if err != nil {
+            return nil, err
+        }
+        levels = append(levels, level)
+        if len(level) <= blockSize {
+            break
+        }
+        r = bytes.NewReader(level)
+        size = uint64(len(level))
+    }
+
+    var tree []byte
+    for i := len(levels) - 1; i >= 0; i-- {
+        tree = append(tree, levels[i]...)
+    }
+    return tree, nil
+}
+
+// writeHashTree computes the verity hash tree described by partition over the
+// extracted image in f and writes it into the image, like update_engine does
+// after applying the operations.
+func writeHashTree(f readerWriterAt, partition *chromeos_update_engine.PartitionUpdate) error {
+    dataExtent := partition.GetHashTreeDataExtent()
+    treeExtent := partition.GetHashTreeExtent()
+    if treeExtent.GetNumBlocks() == 0 {
+        return nil
+    }
+
+    newHash, err := newVerityHash(partition.GetHashTreeAlgorithm())
+    if err != nil {
+        return err
+    }
+
+    dataSize := dataExtent.GetNumBlocks() * blockSize
+    data := io.NewSectionReader(f, int64(dataExtent.GetStartBlock()*blockSize), int64(dataSize))
+    tree, err := buildHashTree(data, dataSize, newHash, partition.GetHashTreeSalt())
+    if err != nil {
+        return err
+    }
+
+    treeSize := treeExtent.GetNumBlocks() * blockSize
+    if uint64(len(tree)) != treeSize {
+        return fmt.Errorf("Hash tree size mismatch: %d != %d", len(tree), treeSize)
+    }
+    return writeExtents(f, []*chromeos_update_engine.Extent{treeExtent}, tree)
+}
@@ -0,0 +1,134 @@
+package payload
+
+import (
+    "bytes"
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/hex"
+    "hash"
+    "io"
+    "testing"
+
+    "google.golang.org/protobuf/proto"
+    "github.com/ssut/payload-dumper-go/chromeos_update_engine"
+)
+
+// memImage is an image held in memory.
+type memImage []byte
+
+func (m memImage) ReadAt(p []byte, off int64) (int, error) {
+    if off >= int64(len(m)) {
+        return 0, io.EOF
+    }
+    n := copy(p, m[off:])
+    if n < len(p) {
+        return n, io.EOF
+    }
+    return n, nil
+}
+
+func (m memImage) WriteAt(p []byte, off int64) (int, error) {
+    if off+int64(len(p)) > int64(len(m)) {
+        return 0, io.ErrShortWrite
+    }
+    return copy(m[off:], p), nil
+}
+
+// verityTestImage returns an image of the given number of blocks that starts
+// with 300 blocks of data.
+func verityTestImage(blocks int) memImage {
+    img := make(memImage, blocks*blockSize)
+    for j := 0; j < 300*blockSize; j++ {
+        img[j] = byte(j*31 + j>>12)
+    }
+    return img
+}
+
+func sha256Hex(b []byte) string {
+    hash := sha256.Sum256(b)
+    return hex.EncodeToString(hash[:])
+}
+
+// The expected trees follow the dm-verity layout avbtool writes, and were
+// computed with Python's hashlib: levels top-first, digests padded to a power
+// of two, levels padded to whole blocks. The root is the salted digest of the
+// top level.
+func TestWriteHashTreeGolden(t *testing.T) {
+    tests := []struct {
+        algorithm string
+        newHash   func() hash.Hash
+        tree      string
+        root      string
+    }{
+        {
+            algorithm: "sha256",
+            newHash:   sha256.New,
+            tree:      "dfa546750e949cb723eae04fee62d0f10c7aa96639ff8716e5d64fd8a5c7e36d",
+            root:      "af129e2a0bdd65a63980e65f0a1121099a90aa73e3773f79b8139e4692a6769a",
+        },
+        {
+            algorithm: "sha1",
+            newHash:   sha1.New,
+            tree:      "b3d0cf5bff790e8c320487e6b5f06517c7cb261aa94517c0ecbcc35bf142315a",
+            root:      "fa851269a004bdd24b5799eac0be70573465e6cb",
+        },
+    }
+    for _, test := range tests {
+        img := verityTestImage(304)
+        partition := &chromeos_update_engine.PartitionUpdate{
+            HashTreeDataExtent: testExtent(0, 300),
+            HashTreeExtent: testExtent(300, 4),
+            HashTreeAlgorithm: proto.String(test.algorithm),
+            HashTreeSalt: []byte("saltysalt"),
+        }
+        if err := writeHashTree(img, partition); err != nil {
+            t.Fatalf("%s: %v", test.algorithm, err)
+        }
+
+        tree := img[300*blockSize:]
+        if got := sha256Hex(tree); got != test.tree {
+            t.Errorf("%s: tree hash %s, want %s", test.algorithm, got, test.tree)
+        }
+        h := test.newHash()
+        h.Write([]byte("saltysalt"))
+        h.Write(tree[:blockSize])
+        if got := hex.EncodeToString(h.Sum(nil)); got != test.root {
+            t.Errorf("%s: root %s, want %s", test.algorithm, got, test.root)
+        }
+    }
+}
+
+// TestWriteHashTreeSingleBlock checks that data of one block gets a tree of
+// one level holding the digest of that block.
+func TestWriteHashTreeSingleBlock(t *testing.T) {
+    img := verityTestImage(301)
+    partition := &chromeos_update_engine.PartitionUpdate{
+        HashTreeDataExtent: testExtent(0, 1),
+        HashTreeExtent: testExtent(300, 1),
+        HashTreeAlgorithm: proto.String("sha256"),
+        HashTreeSalt: []byte("saltysalt"),
+    }
+    if err := writeHashTree(img, partition); err != nil {
+        t.Fatal(err)
+    }
+
+    want := make([]byte, blockSize)
+    h := sha256.New()
+    h.Write([]byte("saltysalt"))
+    h.Write(img[:blockSize])
+    copy(want, h.Sum(nil))
+    if got := img[300*blockSize:]; !bytes.Equal(got, want) {
+        t.Errorf("tree starts with %x, want %x", got[:32], want[:32])
+    }
+}
+
+func TestWriteHashTreeSizeMismatch(t *testing.T) {
+    partition := &chromeos_update_engine.PartitionUpdate{
+        HashTreeDataExtent: testExtent(0, 300),
+        HashTreeExtent: testExtent(300, 3),
+        HashTreeAlgorithm: proto.String("sha256"),
+    }
+    if err := writeHashTree(verityTestImage(304), partition); err == nil {
+        t.Fatal("expected an error for a hash tree extent of the wrong size")
+    }
+}
@@ -0,0 +1,61 @@
+package payload
+
+import (
+    "archive/zip"
+    "fmt"
+    "io"
+    "os"
+)
+
+const zipPayloadName = "payload.bin"
+
+// openZipEntry returns a reader for the payload.bin entry of the OTA zip in r.
+// OTA zips store payload.bin uncompressed, so the entry is normally read in
+// place. Deflated entries are decompressed to a temporary file instead.
+func (p *Payload) openZipEntry(r io.ReaderAt, size int64) (*io.SectionReader, error) {
+    zipReader, err := zip.NewReader(r, size)
+    if err != nil {
+        return nil, fmt.Errorf("Not a valid zip archive: %s (%w)", p.Filename, err)
+    }
+
+    for _, file := range zipReader.File {
+        if file.Name != zipPayloadName || file.UncompressedSize64 == 0 {
+            continue
+        }
+
+        if file.Method == zip.Store {
+            offset, err := file.DataOffset()
+            if err != nil {
+                return nil, err
+            }
+            return io.NewSectionReader(r, offset, int64(file.UncompressedSize64)), nil
+        }
+
+        zippedFile, err := file.Open()
+        if err != nil {
+            return nil, fmt.Errorf("Failed to read zipped file: %s (%w)", file.Name, err)
+        }
+        defer zippedFile.Close()
+
+        tempfile, err := os.CreateTemp(os.TempDir(), "payload_*.bin")
+        if err != nil {
+            return nil, err
+        }
+        p.tempFilename = tempfile.Name()
+
+        n, err := io.Copy(tempfile, zippedFile)
+        if err != nil {
+            tempfile.Close()
+            return nil, err
+        }
+        if p.file != nil {
+            if err := p.file.Close(); err != nil {
+                tempfile.Close()
+                return nil, err
+            }
+        }
+        p.file = tempfile
+        return io.NewSectionReader(tempfile, 0, n), nil
+    }
+    return nil, fmt.Errorf("No %s found in %s", zipPayloadName, p.Filename)
+}
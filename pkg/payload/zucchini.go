@@ -0,0 +1,355 @@
+package payload
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash/crc32"
+    "io"
+
+    "github.com/andybalholm/brotli"
+)
+
+// This file applies Zucchini patches, partially: raw elements, which Zucchini
+// diffs as plain data, are supported. Executable elements (ELF, DEX, PE)
+// additionally correct the references found by Zucchini's disassemblers,
+// which are not implemented, and are rejected with ErrZucchiniUnsupported.
+
+const (
+    zucchiniMagic = 'Z' | 'u'<<8 | 'c'<<16 | 'c'<<24
+    zucchiniMajorVersion = 1
+)
+
+// Patch types of a Zucchini ensemble patch.
+const (
+    zucchiniRawPatch = 0
+    zucchiniSinglePatch = 1
+    zucchiniEnsemblePatch = 2
+)
+
+// zucchiniExeTypeNoOp is the executable type of raw elements.
+const zucchiniExeTypeNoOp = 0
+
+// zucchiniExeTypeNames names the executable types of Zucchini elements, for
+// error messages.
+var zucchiniExeTypeNames = map[uint32]string{
+    1: "Win32 x86",
+    2: "Win32 x64",
+    3: "ELF x86",
+    4: "ELF x64",
+    5: "ELF ARM",
+    6: "ELF AArch64",
+    7: "DEX",
+    8: "ZTF",
+}
+
+var errCorruptZucchiniPatch = errors.New("Corrupt zucchini patch")
+
+// zucchiniSource reads the little-endian values of a Zucchini patch.
+type zucchiniSource struct {
+    buf []byte
+    err error
+}
+
+func (s *zucchiniSource) next(n int) []byte {
+    if s.err != nil || len(s.buf) < n {
+        s.err = errCorruptZucchiniPatch
+        return make([]byte, n)
+    }
+    b := s.buf[:n]
+    s.buf = s.buf[n:]
+    return b
+}
+
+func (s *zucchiniSource) readUint8() uint8 {
+    return s.next(1)[0]
+}
+
+func (s *zucchiniSource) readUint16() uint16 {
+    return binary.LittleEndian.Uint16(s.next(2))
+}
+
+func (s *zucchiniSource) readUint32() uint32 {
+    return binary.LittleEndian.Uint32(s.next(4))
+}
+
+// buffer reads a buffer prefixed with its uint32 size.
+func (s *zucchiniSource) buffer() *zucchiniSource {
+    n := s.readUint32()
+    if uint64(n) > uint64(len(s.buf)) {
+        s.err = errCorruptZucchiniPatch
+        return &zucchiniSource{}
+    }
+    return &zucchiniSource{buf: s.next(int(n))}
+}
+
+// varUint reads an unsigned LEB128 value of at most 32 bits.
+func (s *zucchiniSource) varUint() (uint32, bool) {
+    var v uint32
+    for i, c := range s.buf {
+        if i == 5 {
+            break
+        }
+        v |= uint32(c&0x7F) << (7 * i)
+        if c&0x80 == 0 {
+            s.buf = s.buf[i+1:]
+            return v, true
+        }
+    }
+    return 0, false
+}
+
+// varInt reads a signed value stored as a varUint with the sign in the
+// lowest bit.
+func (s *zucchiniSource) varInt() (int32, bool) {
+    v, ok := s.varUint()
+    if v&1 != 0 {
+        return int32(^(v >> 1)), ok
+    }
+    return int32(v >> 1), ok
+}
+
+// zucchiniEquivalence is a region of the new element copied from the old
+// element, with offsets relative to the elements.
+type zucchiniEquivalence struct {
+    src, dst, length uint32
+}
+
+type zucchiniElement struct {
+    oldOffset, oldLength uint32
+    newOffset, newLength uint32
+    exeType uint32
+
+    equivalences []zucchiniEquivalence
+    extraData []byte
+    rawDeltaSkip *zucchiniSource
+    rawDeltaDiff []byte
+    // referenceDelta and extraTargets correct the references of executable
+    // elements. They are empty for raw elements.
+    referenceDelta []byte
+    extraTargets int
+}
+
+type zucchiniPatch struct {
+    oldSize, oldCRC uint32
+    newSize, newCRC uint32
+    elements []*zucchiniElement
+}
+
+// parseZucchiniEquivalences decodes the equivalences of an element and checks
+// that they lie within the old and new elements.
+func parseZucchiniEquivalences(e *zucchiniElement, srcSkip, dstSkip, copyCount *zucchiniSource) error {
+    var src, dst int64
+    for len(srcSkip.buf) > 0 && len(dstSkip.buf) > 0 && len(copyCount.buf) > 0 {
+        length, ok1 := copyCount.varUint()
+        srcDiff, ok2 := srcSkip.varInt()
+        dstDiff, ok3 := dstSkip.varUint()
+        if !ok1 || !ok2 || !ok3 {
+            return errCorruptZucchiniPatch
+        }
+        src += int64(srcDiff)
+        dst += int64(dstDiff)
+        if src < 0 || src+int64(length) > int64(e.oldLength) || dst+int64(length) > int64(e.newLength) {
+            return errCorruptZucchiniPatch
+        }
+        e.equivalences = append(e.equivalences, zucchiniEquivalence{uint32(src), uint32(dst), length})
+        src += int64(length)
+        dst += int64(length)
+    }
+    if len(srcSkip.buf) > 0 || len(dstSkip.buf) > 0 || len(copyCount.buf) > 0 {
+        return errCorruptZucchiniPatch
+    }
+    return nil
+}
+
+// parseZucchiniPatch parses an ensemble patch. Versioned patches start with
+// major and minor versions and have a version in every element header, older
+// patches have neither.
+func parseZucchiniPatch(patch []byte, versioned bool) (*zucchiniPatch, error) {
+    s := &zucchiniSource{buf: patch}
+    if s.readUint32() != zucchiniMagic {
+        return nil, errors.New("Invalid zucchini magic")
+    }
+    if versioned {
+        if major := s.readUint16(); major != zucchiniMajorVersion {
+            return nil, fmt.Errorf("Unsupported zucchini patch version: %d", major)
+        }
+        s.readUint16()
+    }
+    p := &zucchiniPatch{
+        oldSize: s.readUint32(),
+        oldCRC: s.readUint32(),
+        newSize: s.readUint32(),
+        newCRC: s.readUint32(),
+    }
+    patchType := s.readUint32()
+    count := s.readUint32()
+    if s.err != nil {
+        return nil, s.err
+    }
+    switch patchType {
+    case zucchiniRawPatch, zucchiniSinglePatch:
+        if count != 1 {
+            return nil, errCorruptZucchiniPatch
+        }
+    case zucchiniEnsemblePatch:
+    default:
+        return nil, fmt.Errorf("Unsupported zucchini patch type: %d", patchType)
+    }
+
+    var newEnd uint64
+    for i := uint32(0); i < count; i++ {
+        e := &zucchiniElement{
+            oldOffset: s.readUint32(),
+            oldLength: s.readUint32(),
+            newOffset: s.readUint32(),
+            newLength: s.readUint32(),
+            exeType: s.readUint32(),
+        }
+        if versioned {
+            s.readUint16()
+        }
+        srcSkip, dstSkip, copyCount := s.buffer(), s.buffer(), s.buffer()
+        e.extraData = s.buffer().buf
+        e.rawDeltaSkip = s.buffer()
+        e.rawDeltaDiff = s.buffer().buf
+        e.referenceDelta = s.buffer().buf
+        for pools := s.readUint32(); pools > 0 && s.err == nil; pools-- {
+            s.readUint8()
+            e.extraTargets += len(s.buffer().buf)
+        }
+        if s.err != nil {
+            return nil, s.err
+        }
+
+        // Elements cover the new data in order, without gaps.
+        if uint64(e.oldOffset)+uint64(e.oldLength) > uint64(p.oldSize) ||
+            uint64(e.newOffset) != newEnd {
+            return nil, errCorruptZucchiniPatch
+        }
+        newEnd += uint64(e.newLength)
+        if err := parseZucchiniEquivalences(e, srcSkip, dstSkip, copyCount); err != nil {
+            return nil, err
+        }
+        p.elements = append(p.elements, e)
+    }
+    if len(s.buf) > 0 || newEnd != uint64(p.newSize) {
+        return nil, errCorruptZucchiniPatch
+    }
+    return p, nil
+}
+
+// apply writes the new element to out from the old element.
+func (e *zucchiniElement) apply(old []byte, out []byte) error {
+    if e.exeType != zucchiniExeTypeNoOp {
+        name, ok := zucchiniExeTypeNames[e.exeType]
+        if !ok {
+            name = fmt.Sprintf("type %d", e.exeType)
+        }
+        return fmt.Errorf("%w (%s element)", ErrZucchiniUnsupported, name)
+    }
+    // Raw elements have no references to correct.
+    if len(e.referenceDelta) > 0 || e.extraTargets > 0 {
+        return errCorruptZucchiniPatch
+    }
+
+    // The gaps between the equivalences are filled with extra data.
+    extra := e.extraData
+    var pos uint32
+    for _, eq := range append(e.equivalences, zucchiniEquivalence{dst: e.newLength}) {
+        gap := eq.dst - pos
+        if uint64(gap) > uint64(len(extra)) {
+            return errCorruptZucchiniPatch
+        }
+        pos += uint32(copy(out[pos:eq.dst], extra[:gap]))
+        extra = extra[gap:]
+        pos += uint32(copy(out[pos:pos+eq.length], old[eq.src:eq.src+eq.length]))
+    }
+    if len(extra) > 0 {
+        return errCorruptZucchiniPatch
+    }
+
+    // The raw delta adds a byte to some of the copied bytes. Its offsets
+    // count the copied bytes only, in order.
+    skip, diff := e.rawDeltaSkip, e.rawDeltaDiff
+    var offset, base uint64
+    i := 0
+    for len(skip.buf) > 0 && len(diff) > 0 {
+        v, ok := skip.varUint()
+        if !ok || diff[0] == 0 {
+            return errCorruptZucchiniPatch
+        }
+        copyOffset := offset + uint64(v)
+        offset = copyOffset + 1
+        for i < len(e.equivalences) && base+uint64(e.equivalences[i].length) <= copyOffset {
+            base += uint64(e.equivalences[i].length)
+            i++
+        }
+        if i == len(e.equivalences) {
+            return errCorruptZucchiniPatch
+        }
+        out[uint64(e.equivalences[i].dst)+copyOffset-base] += diff[0]
+        diff = diff[1:]
+    }
+    if len(skip.buf) > 0 || len(diff) > 0 {
+        return errCorruptZucchiniPatch
+    }
+    return nil
+}
+
+// zucchiniPatchData returns the Zucchini patch in data, which update_engine
+// and puffin store compressed with brotli.
+func zucchiniPatchData(data []byte) ([]byte, error) {
+    if len(data) >= 4 && binary.LittleEndian.Uint32(data) == zucchiniMagic {
+        return data, nil
+    }
+    patch, err := io.ReadAll(brotli.NewReader(bytes.NewReader(data)))
+    if err != nil {
+        return nil, fmt.Errorf("Failed to decompress zucchini patch: %w", err)
+    }
+    return patch, nil
+}
+
+// zucchinipatch applies a Zucchini patch to old and returns the new data,
+// which may not be larger than limit. It stops with ctx.Err() once ctx is
+// done.
+func zucchinipatch(ctx context.Context, old []byte, data []byte, limit int64) ([]byte, error) {
+    patch, err := zucchiniPatchData(data)
+    if err != nil {
+        return nil, err
+    }
+    p, err := parseZucchiniPatch(patch, true)
+    if err != nil || uint64(p.oldSize) != uint64(len(old)) {
+        legacy, legacyErr := parseZucchiniPatch(patch, false)
+        if legacyErr == nil && uint64(legacy.oldSize) == uint64(len(old)) {
+            p, err = legacy, nil
+        }
+    }
+    if err != nil {
+        return nil, err
+    }
+
+    if uint64(p.oldSize) != uint64(len(old)) || crc32.ChecksumIEEE(old) != p.oldCRC {
+        return nil, errors.New("Zucchini patch does not match the source data")
+    }
+    if int64(p.newSize) > limit {
+        return nil, fmt.Errorf("Patched data is too large: %d > %d", p.newSize, limit)
+    }
+
+    newData := make([]byte, p.newSize)
+    for _, e := range p.elements {
+        if err := ctx.Err(); err != nil {
+            return nil, err
+        }
+        err := e.apply(old[e.oldOffset:e.oldOffset+e.oldLength], newData[e.newOffset:e.newOffset+e.newLength])
+        if err != nil {
+            return nil, err
+        }
+    }
+    if crc32.ChecksumIEEE(newData) != p.newCRC {
+        return nil, errors.New("Zucchini patch produced corrupt data")
+    }
+    return newData, nil
+}
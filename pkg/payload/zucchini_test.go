@@ -0,0 +1,135 @@
+package payload
+
+import (
+    "bytes"
+    "context"
+    "encoding/binary"
+    "errors"
+    "hash/crc32"
+    "strings"
+    "testing"
+
+    "github.com/andybalholm/brotli"
+)
+
+type zucchiniBuilder struct {
+    bytes.Buffer
+}
+
+func (b *zucchiniBuilder) uint32(v uint32) {
+    binary.Write(b, binary.LittleEndian, v)
+}
+
+func (b *zucchiniBuilder) buffer(data []byte) {
+    b.uint32(uint32(len(data)))
+    b.Write(data)
+}
+
+func varUint(v uint32) []byte {
+    var out []byte
+    for v >= 0x80 {
+        out = append(out, byte(v)|0x80)
+        v >>= 7
+    }
+    return append(out, byte(v))
+}
+
+func varInt(v int32) []byte {
+    if v < 0 {
+        return varUint(uint32(^v)<<1 | 1)
+    }
+    return varUint(uint32(v) << 1)
+}
+
+// zucchiniTestPatch builds a patch with a single element of the given
+// executable type. The new data is "XYZ", old[10:18], "!", old[4:9] and "??",
+// with the third and tenth copied bytes changed by the raw delta.
+func zucchiniTestPatch(old []byte, versioned bool, exeType uint32) (patch []byte, newData []byte) {
+    newData = concat([]byte("XYZ"), old[10:18], []byte("!"), old[4:9], []byte("??"))
+    newData[3+2] += 1
+    newData[12+1] -= 2
+
+    b := &zucchiniBuilder{}
+    b.uint32(zucchiniMagic)
+    if versioned {
+        binary.Write(b, binary.LittleEndian, [2]uint16{1, 0})
+    }
+    b.uint32(uint32(len(old)))
+    b.uint32(crc32.ChecksumIEEE(old))
+    b.uint32(uint32(len(newData)))
+    b.uint32(crc32.ChecksumIEEE(newData))
+    b.uint32(zucchiniRawPatch)
+    b.uint32(1)
+
+    b.uint32(0)
+    b.uint32(uint32(len(old)))
+    b.uint32(0)
+    b.uint32(uint32(len(newData)))
+    b.uint32(exeType)
+    if versioned {
+        binary.Write(b, binary.LittleEndian, uint16(1))
+    }
+    b.buffer(concat(varInt(10), varInt(4-18)))
+    b.buffer(concat(varUint(3), varUint(1)))
+    b.buffer(concat(varUint(8), varUint(5)))
+    b.buffer([]byte("XYZ!??"))
+    b.buffer(concat(varUint(2), varUint(9-3)))
+    b.buffer([]byte{1, 0xFE})
+    b.buffer(nil)
+    b.uint32(0)
+    return b.Bytes(), newData
+}
+
+func TestZucchiniPatch(t *testing.T) {
+    old := make([]byte, 64)
+    for i := range old {
+        old[i] = byte(i)
+    }
+
+    for _, versioned := range []bool{true, false} {
+        patch, want := zucchiniTestPatch(old, versioned, zucchiniExeTypeNoOp)
+
+        var compressed bytes.Buffer
+        w := brotli.NewWriter(&compressed)
+        w.Write(patch)
+        w.Close()
+
+        for _, data := range [][]byte{patch, compressed.Bytes()} {
+            got, err := zucchinipatch(context.Background(), old, data, int64(len(want)))
+            if err != nil {
+                t.Fatalf("versioned %v: %v", versioned, err)
+            }
+            if !bytes.Equal(got, want) {
+                t.Fatalf("versioned %v: got %q, want %q", versioned, got, want)
+            }
+        }
+    }
+}
+
+func TestZucchiniPatchErrors(t *testing.T) {
+    old := make([]byte, 64)
+    patch, want := zucchiniTestPatch(old, true, zucchiniExeTypeNoOp)
+
+    if _, err := zucchinipatch(context.Background(), old, patch, int64(len(want))-1); err == nil {
+        t.Fatal("expected an error for output larger than the limit")
+    }
+    if _, err := zucchinipatch(context.Background(), append(old, 0), patch, int64(len(want))); err == nil {
+        t.Fatal("expected an error for a different source")
+    }
+    if _, err := zucchinipatch(context.Background(), old, patch[:len(patch)-1], int64(len(want))); err == nil {
+        t.Fatal("expected an error for a truncated patch")
+    }
+
+    // Raw elements can not have reference corrections.
+    withReferences := concat(patch[:len(patch)-8], []byte{1, 0, 0, 0, 0x2A, 0, 0, 0, 0})
+    if _, err := zucchinipatch(context.Background(), old, withReferences, int64(len(want))); err == nil {
+        t.Fatal("expected an error for a raw element with a reference delta")
+    }
+
+    // Executable elements are not supported.
+    patch, want = zucchiniTestPatch(old, true, 6)
+    _, err := zucchinipatch(context.Background(), old, patch, int64(len(want)))
+    if !errors.Is(err, ErrZucchiniUnsupported) || !strings.Contains(err.Error(), "ELF AArch64") {
+        t.Fatalf("got %v, want ErrZucchiniUnsupported for an ELF AArch64 element", err)
+    }
+}